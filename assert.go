@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func (s *_Server) AssertGETRequestMade(t testing.TB, key string) {
+	t.Helper()
+	s.AssertRequestMade(t, http.MethodGet, key)
+}
+
+func (s *_Server) AssertNoGETRequests(t testing.TB) {
+	t.Helper()
+	s.assertNoRequests(t, http.MethodGet)
+}
+
+func (s *_Server) AssertNoPOSTRequests(t testing.TB) {
+	t.Helper()
+	s.assertNoRequests(t, http.MethodPost)
+}
+
+func (s *_Server) AssertNoPanics(t testing.TB) {
+	t.Helper()
+	s.assertionWaitGroup.Wait()
+
+	s.assertionMutex.Lock()
+	defer s.assertionMutex.Unlock()
+	for _, message := range s.assertionPanics {
+		t.Errorf("expected no panics, but %v", message)
+	}
+}
+
+func (s *_Server) AssertNoRequests(t testing.TB) {
+	t.Helper()
+	for _, method := range supportedMethods {
+		s.assertNoRequests(t, method)
+	}
+}
+
+func (s *_Server) AssertPATCHRequestMade(t testing.TB, key string) {
+	t.Helper()
+	s.AssertRequestMade(t, http.MethodPatch, key)
+}
+
+func (s *_Server) AssertPOSTRequestMade(t testing.TB, key string) {
+	t.Helper()
+	s.AssertRequestMade(t, http.MethodPost, key)
+}
+
+func (s *_Server) AssertRequestBodyEquals(t testing.TB, method, key string, index int, expected string) {
+	t.Helper()
+
+	s.requestsMutex.RLock()
+	entry, ok := s.requestEntry(method, key, index)
+	s.requestsMutex.RUnlock()
+	if !ok {
+		t.Errorf("expected %v request to '%v', but none was made", method, key)
+		return
+	}
+
+	var actualJSON, expectedJSON interface{}
+	if json.Unmarshal(entry.Body, &actualJSON) == nil && json.Unmarshal([]byte(expected), &expectedJSON) == nil {
+		if !reflect.DeepEqual(actualJSON, expectedJSON) {
+			t.Errorf("expected %v request to '%v' to have body %v, but got %v (-expected +actual):\n%v",
+				method, key, expected, string(entry.Body), jsonDiff(expectedJSON, actualJSON))
+		}
+		return
+	}
+
+	if string(entry.Body) != expected {
+		t.Errorf("expected %v request to '%v' to have body %v, but got %v (first difference at offset %v)",
+			method, key, expected, string(entry.Body), commonPrefixLength(expected, string(entry.Body)))
+	}
+}
+
+func (s *_Server) AssertRequestMade(t testing.TB, method, key string) {
+	t.Helper()
+	if s.requestsMade(method, key) == 0 {
+		t.Errorf("expected %v request to '%v', but none was made", method, key)
+	}
+}
+
+func (s *_Server) VerifyAllExpectations(t testing.TB) {
+	t.Helper()
+	for _, method := range supportedMethods {
+		for _, key := range s.GetAllRegisteredKeys(method) {
+			if s.requestsMade(method, key) == 0 {
+				t.Errorf("registered response for %v '%v' was never called", method, key)
+			}
+		}
+	}
+
+	routes := make([]_Route, 0, len(s.expectations))
+	for route := range s.expectations {
+		routes = append(routes, route)
+	}
+	sortRoutes(routes)
+
+	for _, route := range routes {
+		expectation := s.expectations[route]
+		n := s.requestsMade(route.Method, route.Key)
+		switch {
+		case expectation.atLeast == expectation.atMost && n != expectation.atLeast:
+			t.Errorf("expected exactly %v %v requests for '%v', but got %v", expectation.atLeast, route.Method, route.Key, n)
+		case n < expectation.atLeast:
+			t.Errorf("expected at least %v %v requests for '%v', but got %v", expectation.atLeast, route.Method, route.Key, n)
+		case expectation.atMost >= 0 && n > expectation.atMost:
+			t.Errorf("expected at most %v %v requests for '%v', but got %v", expectation.atMost, route.Method, route.Key, n)
+		}
+	}
+}
+
+// privates
+func (s *_Server) assertNoRequests(t testing.TB, method string) {
+	t.Helper()
+
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	requests := s.requestsFor(method)
+	keys := make([]string, 0, len(requests))
+	for key := range requests {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if n := len(requests[key]); n > 0 {
+			t.Errorf("expected no %v requests, but got %v for '%v'", method, n, key)
+		}
+	}
+}
+
+// jsonDiff compares the indented JSON of expected and
+// actual line by line
+func jsonDiff(expected, actual interface{}) string {
+	expectedJSON, _ := json.MarshalIndent(expected, "", "  ")
+	actualJSON, _ := json.MarshalIndent(actual, "", "  ")
+	expectedLines := strings.Split(string(expectedJSON), "\n")
+	actualLines := strings.Split(string(actualJSON), "\n")
+
+	var diff strings.Builder
+	for i := 0; i < len(expectedLines) || i < len(actualLines); i++ {
+		var expectedLine, actualLine string
+		if i < len(expectedLines) {
+			expectedLine = expectedLines[i]
+		}
+		if i < len(actualLines) {
+			actualLine = actualLines[i]
+		}
+
+		switch {
+		case expectedLine == actualLine:
+			fmt.Fprintf(&diff, "  %v\n", expectedLine)
+		default:
+			if i < len(expectedLines) {
+				fmt.Fprintf(&diff, "- %v\n", expectedLine)
+			}
+			if i < len(actualLines) {
+				fmt.Fprintf(&diff, "+ %v\n", actualLine)
+			}
+		}
+	}
+	return diff.String()
+}
@@ -0,0 +1,44 @@
+//go:build go1.18
+// +build go1.18
+
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// TypedAssertRequest unmarshals the JSON body of the index-th
+// request for the given method and key as T and fails t with
+// a diff unless it equals expected
+func TypedAssertRequest[T any](t testing.TB, s Server, method, key string, index int, expected T) {
+	t.Helper()
+
+	var body []byte
+	found := false
+	for _, entry := range s.RequestLog() {
+		if entry.Method != method || entry.Key != key {
+			continue
+		}
+		if index == 0 {
+			body, found = entry.Body, true
+			break
+		}
+		index--
+	}
+	if !found {
+		t.Errorf("expected %v request to '%v', but none was made", method, key)
+		return
+	}
+
+	var actual T
+	if err := json.Unmarshal(body, &actual); err != nil {
+		t.Errorf("expected %v request to '%v' to have a JSON body, but got %v", method, key, err)
+		return
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v request to '%v' to match (-expected +actual):\n%v", method, key, jsonDiff(expected, actual))
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Cassette holds the interactions recorded between
+// StartRecording and StopRecording
+type Cassette struct {
+	Interactions []Interaction
+}
+
+// Interaction is a request keyed like any other request
+// and the response the upstream server sent for it
+type Interaction struct {
+	Method   string
+	Key      string
+	Response Response
+}
+
+type _Recording struct {
+	upstream *url.URL
+	mutex    sync.Mutex
+	cassette Cassette
+}
+
+func (s *_Server) LoadCassette(c Cassette) {
+	var routes []_Route
+	responses := map[_Route][]Response{}
+	for _, interaction := range c.Interactions {
+		route := _Route{Method: interaction.Method, Key: interaction.Key}
+		if _, ok := responses[route]; !ok {
+			routes = append(routes, route)
+		}
+		responses[route] = append(responses[route], interaction.Response)
+	}
+
+	for _, route := range routes {
+		if len(responses[route]) > 1 {
+			s.SetResponseRoundRobin(route.Method, route.Key, responses[route])
+			continue
+		}
+		if static := s.responsesFor(route.Method); static != nil {
+			static[route.Key] = responses[route][0]
+		}
+	}
+}
+
+func (s *_Server) StartRecording(upstreamURL string) error {
+	upstream, err := url.Parse(strings.TrimSuffix(upstreamURL, "/"))
+	if err != nil {
+		return err
+	}
+	s.recording = &_Recording{upstream: upstream}
+	return nil
+}
+
+func (s *_Server) StopRecording() Cassette {
+	recording := s.recording
+	s.recording = nil
+	if recording == nil {
+		return Cassette{}
+	}
+
+	recording.mutex.Lock()
+	defer recording.mutex.Unlock()
+	return recording.cassette
+}
+
+// privates
+
+// proxyClient returns redirects as they are so that they
+// are recorded instead of the response they lead to
+var proxyClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (s *_Server) proxy(w http.ResponseWriter, r *http.Request, rec *_Recording, method, key string, body []byte) {
+	req, err := http.NewRequest(r.Method, rec.upstream.String()+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header = r.Header.Clone()
+
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Upstream request for '%v' failed: %v", key, err), http.StatusBadGateway)
+		return
+	}
+
+	response, err := readResponse(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	rec.mutex.Lock()
+	rec.cassette.Interactions = append(rec.cassette.Interactions, Interaction{
+		Method:   method,
+		Key:      key,
+		Response: response,
+	})
+	rec.mutex.Unlock()
+
+	s.writeResponse(w, response)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// _GRPCTranscodingMatcher keys POST requests for transcoded
+// gRPC methods by their normalized JSON body
+type _GRPCTranscodingMatcher struct {
+	paths map[string]bool
+}
+
+func (m *_GRPCTranscodingMatcher) Match(r *http.Request) (string, bool) {
+	if !m.paths[r.URL.Path] {
+		return "", false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", false
+	}
+	return r.URL.Path + "?" + r.URL.RawQuery + " " + string(normalizeJSON(body)), true
+}
+
+func (s *_Server) SetGRPCTranscodingResponse(protoMethod string, requestProto proto.Message, statusCode int, responseProto proto.Message) error {
+	marshaler := jsonpb.Marshaler{}
+
+	var request bytes.Buffer
+	if err := marshaler.Marshal(&request, requestProto); err != nil {
+		return err
+	}
+
+	var response bytes.Buffer
+	if err := marshaler.Marshal(&response, responseProto); err != nil {
+		return err
+	}
+
+	path := "/" + strings.TrimPrefix(protoMethod, "/")
+	if s.grpcTranscodingMatcher == nil {
+		s.grpcTranscodingMatcher = &_GRPCTranscodingMatcher{paths: map[string]bool{}}
+		s.RegisterMatcher(http.MethodPost, s.grpcTranscodingMatcher)
+	}
+	s.grpcTranscodingMatcher.paths[path] = true
+
+	s.httpPOSTResponses[path+"? "+string(normalizeJSON(request.Bytes()))] = Response{
+		StatusCode:  statusCode,
+		ContentType: "application/json",
+		Headers:     make(http.Header),
+		Body:        response.String(),
+	}
+	return nil
+}
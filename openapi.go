@@ -0,0 +1,282 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type _OpenAPISpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*_OpenAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type _OpenAPIOperation struct {
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema  *_OpenAPISchema `json:"schema"`
+			Example interface{}     `json:"example"`
+		} `json:"content"`
+	} `json:"responses"`
+}
+
+type _OpenAPISchema struct {
+	Ref        string                     `json:"$ref"`
+	Type       string                     `json:"type"`
+	Properties map[string]*_OpenAPISchema `json:"properties"`
+	Items      *_OpenAPISchema            `json:"items"`
+	AllOf      []*_OpenAPISchema          `json:"allOf"`
+	OneOf      []*_OpenAPISchema          `json:"oneOf"`
+	AnyOf      []*_OpenAPISchema          `json:"anyOf"`
+	Enum       []interface{}              `json:"enum"`
+	Example    interface{}                `json:"example"`
+	Default    interface{}                `json:"default"`
+}
+
+// _OpenAPIMatcher keys requests for templated
+// OpenAPI paths such as /users/{id} by the template,
+// unless exact reports a response for the literal key
+type _OpenAPIMatcher struct {
+	templates []_OpenAPIPathTemplate
+	exact     func(key string) bool
+}
+
+type _OpenAPIPathTemplate struct {
+	path   string
+	regexp *regexp.Regexp
+	params []string
+}
+
+var openAPIPathParam = regexp.MustCompile(`\{[^}/]+\}`)
+
+func (m *_OpenAPIMatcher) Match(r *http.Request) (string, bool) {
+	for _, template := range m.templates {
+		if template.regexp.MatchString(r.URL.Path) {
+			if m.exact(r.URL.Path + "?" + r.URL.RawQuery) {
+				return "", false
+			}
+			return template.path + "?" + r.URL.RawQuery, true
+		}
+	}
+	return "", false
+}
+
+func (m *_OpenAPIMatcher) PathParams(r *http.Request) map[string]string {
+	for _, template := range m.templates {
+		values := template.regexp.FindStringSubmatch(r.URL.Path)
+		if values == nil {
+			continue
+		}
+
+		params := map[string]string{}
+		for i, name := range template.params {
+			params[name] = values[i+1]
+		}
+		return params
+	}
+	return nil
+}
+
+func (s *_Server) SetupFromOpenAPISpec(spec []byte) error {
+	var document interface{}
+	if err := yaml.Unmarshal(spec, &document); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(stringKeys(document))
+	if err != nil {
+		return err
+	}
+
+	var openAPI _OpenAPISpec
+	if err := json.Unmarshal(data, &openAPI); err != nil {
+		return err
+	}
+
+	if s.openAPIMatcher == nil {
+		s.openAPIMatcher = &_OpenAPIMatcher{
+			exact: s.hasGETResponse,
+		}
+		s.RegisterMatcher(http.MethodGet, s.openAPIMatcher)
+	}
+
+	for path, item := range openAPI.Paths {
+		raw, ok := item["get"]
+		if !ok {
+			continue
+		}
+
+		var operation _OpenAPIOperation
+		if err := json.Unmarshal(raw, &operation); err != nil {
+			return fmt.Errorf("Invalid GET operation for '%v': %v", path, err)
+		}
+
+		response, ok := openAPIResponse(operation, openAPI.Components.Schemas)
+		if !ok {
+			continue
+		}
+		s.httpGETResponses[path+"?"] = response
+
+		if openAPIPathParam.MatchString(path) {
+			literals := openAPIPathParam.Split(path, -1)
+			for i := range literals {
+				literals[i] = regexp.QuoteMeta(literals[i])
+			}
+			var params []string
+			for _, param := range openAPIPathParam.FindAllString(path, -1) {
+				params = append(params, strings.Trim(param, "{}"))
+			}
+			s.openAPIMatcher.addTemplate(_OpenAPIPathTemplate{
+				path:   path,
+				regexp: regexp.MustCompile("^" + strings.Join(literals, "([^/]+)") + "$"),
+				params: params,
+			})
+		}
+	}
+	return nil
+}
+
+// privates
+func (m *_OpenAPIMatcher) addTemplate(template _OpenAPIPathTemplate) {
+	for i := range m.templates {
+		if m.templates[i].path == template.path {
+			m.templates[i] = template
+			return
+		}
+	}
+	m.templates = append(m.templates, template)
+}
+
+// openAPIResponse builds a response from the first 2xx
+// response of operation, generating a JSON example
+// body from its schema when it has no example
+func openAPIResponse(operation _OpenAPIOperation, schemas map[string]*_OpenAPISchema) (Response, bool) {
+	codes := make([]string, 0, len(operation.Responses))
+	for code := range operation.Responses {
+		if strings.HasPrefix(code, "2") {
+			codes = append(codes, code)
+		}
+	}
+	if len(codes) == 0 {
+		return Response{}, false
+	}
+	sort.Strings(codes)
+
+	statusCode, err := strconv.Atoi(codes[0])
+	if err != nil {
+		statusCode = http.StatusOK
+	}
+
+	response := Response{
+		StatusCode: statusCode,
+		Headers:    make(http.Header),
+	}
+
+	content := operation.Responses[codes[0]].Content
+	mediaType, ok := content["application/json"]
+	if !ok {
+		return response, true
+	}
+
+	example := mediaType.Example
+	if example == nil {
+		example = openAPIExample(mediaType.Schema, schemas, map[string]bool{})
+	}
+
+	body, err := json.Marshal(example)
+	if err != nil {
+		return response, true
+	}
+	response.Body = string(body)
+	return response, true
+}
+
+// openAPIExample generates a minimal value valid for schema,
+// resolving references to components in schemas. seen guards
+// against recursive references
+func openAPIExample(schema *_OpenAPISchema, schemas map[string]*_OpenAPISchema, seen map[string]bool) interface{} {
+	if schema == nil {
+		return nil
+	}
+
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		defer delete(seen, name)
+		return openAPIExample(schemas[name], schemas, seen)
+	}
+
+	switch {
+	case schema.Example != nil:
+		return schema.Example
+	case schema.Default != nil:
+		return schema.Default
+	case len(schema.Enum) > 0:
+		return schema.Enum[0]
+	case len(schema.AllOf) > 0:
+		merged := map[string]interface{}{}
+		for _, sub := range schema.AllOf {
+			if object, ok := openAPIExample(sub, schemas, seen).(map[string]interface{}); ok {
+				for name, value := range object {
+					merged[name] = value
+				}
+			}
+		}
+		return merged
+	case len(schema.OneOf) > 0:
+		return openAPIExample(schema.OneOf[0], schemas, seen)
+	case len(schema.AnyOf) > 0:
+		return openAPIExample(schema.AnyOf[0], schemas, seen)
+	}
+
+	switch schema.Type {
+	case "array":
+		item := openAPIExample(schema.Items, schemas, seen)
+		if item == nil {
+			return []interface{}{}
+		}
+		return []interface{}{item}
+	case "boolean":
+		return false
+	case "integer", "number":
+		return 0
+	case "string":
+		return "string"
+	}
+
+	object := map[string]interface{}{}
+	for name, property := range schema.Properties {
+		object[name] = openAPIExample(property, schemas, seen)
+	}
+	return object
+}
+
+// stringKeys converts the map[interface{}]interface{} values
+// produced by yaml.Unmarshal to map[string]interface{} so
+// they can be encoded as JSON
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			converted[fmt.Sprint(key)] = stringKeys(value)
+		}
+		return converted
+	case []interface{}:
+		for i, value := range v {
+			v[i] = stringKeys(value)
+		}
+	}
+	return v
+}
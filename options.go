@@ -0,0 +1,81 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Option configures a Server constructed by New
+type Option func(*_Server)
+
+// WithDuplicateWindow sets how close together requests
+// with the same body must arrive to be reported by
+// GetDuplicateRequests. The default is one second
+func WithDuplicateWindow(d time.Duration) Option {
+	return func(s *_Server) {
+		s.duplicateWindow = d
+	}
+}
+
+// WithGETKeyFunc replaces the computation of the key of GET
+// requests, normally "path?query", with fn. Requests matched
+// by a Matcher keep the key of the matcher
+func WithGETKeyFunc(fn func(r *http.Request, body []byte) string) Option {
+	return func(s *_Server) {
+		s.getKeyFunc = fn
+	}
+}
+
+// WithLogger makes the Server write one line per request to w
+// in the format "METHOD path?query -> statusCode bodySize elapsed".
+// Passing a nil w disables logging
+func WithLogger(w io.Writer) Option {
+	return func(s *_Server) {
+		if w == nil {
+			s.logger = nil
+			return
+		}
+		s.logger = log.New(w, "", 0)
+	}
+}
+
+// WithPOSTKeyFunc replaces the computation of the key of POST
+// requests, normally "path?query <file content>", with fn.
+// Requests matched by a Matcher keep the key of the matcher
+func WithPOSTKeyFunc(fn func(r *http.Request, body []byte) string) Option {
+	return func(s *_Server) {
+		s.postKeyFunc = fn
+	}
+}
+
+// WithRequestTimeout sets the read timeout of the underlying
+// http.Server, the maximum duration for reading an entire
+// request including the body
+func WithRequestTimeout(d time.Duration) Option {
+	return func(s *_Server) {
+		s.readTimeout = d
+	}
+}
+
+// WithTestingLogger makes the Server log like WithLogger
+// through t.Log, prefixing each line with the name of the
+// test, so the lines are shown only on failure or with -v
+func WithTestingLogger(t testing.TB) Option {
+	return func(s *_Server) {
+		s.logger = log.New(_TestingWriter{t: t}, "", 0)
+	}
+}
+
+// privates
+type _TestingWriter struct {
+	t testing.TB
+}
+
+func (w _TestingWriter) Write(b []byte) (int, error) {
+	w.t.Log(w.t.Name() + ": " + strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
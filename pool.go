@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// ServerPool manages several independent Servers, which
+// is useful for testing client-side load balancing and
+// failover
+type ServerPool interface {
+	// CloseAll shuts every server in the pool down
+	CloseAll() error
+
+	// GetAllGETRequests retrieves requests for the given
+	// key where key is "path?query" from every server,
+	// in the same order as Servers
+	GetAllGETRequests(key string) [][]http.Request
+
+	// Reset calls Reset on every server in the pool
+	Reset()
+
+	// Servers returns the servers in the pool
+	Servers() []Server
+
+	// SetGETResponseBodyAll calls SetGETResponseBody
+	// on every server in the pool
+	SetGETResponseBodyAll(key, body string)
+
+	// URLs returns the url of every server in the pool,
+	// in the same order as Servers
+	URLs() []url.URL
+}
+
+type _ServerPool struct {
+	servers []Server
+}
+
+// NewPool constructs and opens n Servers configured
+// by the given options
+func NewPool(n int, opts ...Option) (ServerPool, error) {
+	p := &_ServerPool{}
+	for i := 0; i < n; i++ {
+		s := New(opts...)
+		if err := s.Open(); err != nil {
+			p.CloseAll()
+			return nil, err
+		}
+		p.servers = append(p.servers, s)
+	}
+	return p, nil
+}
+
+func (p *_ServerPool) CloseAll() error {
+	for _, s := range p.servers {
+		s.Close()
+	}
+	return nil
+}
+
+func (p *_ServerPool) GetAllGETRequests(key string) [][]http.Request {
+	requests := make([][]http.Request, 0, len(p.servers))
+	for _, s := range p.servers {
+		requests = append(requests, s.GetGETRequests(key))
+	}
+	return requests
+}
+
+func (p *_ServerPool) Reset() {
+	for _, s := range p.servers {
+		s.Reset()
+	}
+}
+
+func (p *_ServerPool) Servers() []Server {
+	return append([]Server{}, p.servers...)
+}
+
+func (p *_ServerPool) SetGETResponseBodyAll(key, body string) {
+	for _, s := range p.servers {
+		s.SetGETResponseBody(key, body)
+	}
+}
+
+func (p *_ServerPool) URLs() []url.URL {
+	urls := make([]url.URL, 0, len(p.servers))
+	for _, s := range p.servers {
+		urls = append(urls, *s.URL())
+	}
+	return urls
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var prometheusBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type _RouteStats struct {
+	mutex    sync.Mutex
+	routes   map[_Route]*_RouteStat
+	statuses map[_Route]map[int]int64
+}
+
+type _RouteStat struct {
+	requests int64
+	buckets  []int64
+	sum      float64
+}
+
+func (s *_Server) SetPrometheusMetricsPath(path string) {
+	s.prometheusMetricsPath = path
+}
+
+// privates
+func newRouteStats() *_RouteStats {
+	return &_RouteStats{
+		routes:   map[_Route]*_RouteStat{},
+		statuses: map[_Route]map[int]int64{},
+	}
+}
+
+func (rs *_RouteStats) record(route _Route, statusCode int, elapsed time.Duration) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	stat, ok := rs.routes[route]
+	if !ok {
+		stat = &_RouteStat{buckets: make([]int64, len(prometheusBuckets))}
+		rs.routes[route] = stat
+		rs.statuses[route] = map[int]int64{}
+	}
+
+	seconds := elapsed.Seconds()
+	stat.requests++
+	stat.sum += seconds
+	for i, bucket := range prometheusBuckets {
+		if seconds <= bucket {
+			stat.buckets[i]++
+		}
+	}
+	rs.statuses[route][statusCode]++
+}
+
+func (rs *_RouteStats) writePrometheus(w io.Writer) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	routes := make([]_Route, 0, len(rs.routes))
+	for route := range rs.routes {
+		routes = append(routes, route)
+	}
+	sortRoutes(routes)
+
+	fmt.Fprintln(w, "# HELP test_server_requests_total Requests received by the test server.")
+	fmt.Fprintln(w, "# TYPE test_server_requests_total counter")
+	for _, route := range routes {
+		fmt.Fprintf(w, "test_server_requests_total{%v} %v\n", prometheusLabels(route), rs.routes[route].requests)
+	}
+
+	fmt.Fprintln(w, "# HELP test_server_request_duration_seconds Time taken to respond to requests.")
+	fmt.Fprintln(w, "# TYPE test_server_request_duration_seconds histogram")
+	for _, route := range routes {
+		stat, labels := rs.routes[route], prometheusLabels(route)
+		for i, bucket := range prometheusBuckets {
+			fmt.Fprintf(w, "test_server_request_duration_seconds_bucket{%v,le=\"%v\"} %v\n", labels, bucket, stat.buckets[i])
+		}
+		fmt.Fprintf(w, "test_server_request_duration_seconds_bucket{%v,le=\"+Inf\"} %v\n", labels, stat.requests)
+		fmt.Fprintf(w, "test_server_request_duration_seconds_sum{%v} %v\n", labels, stat.sum)
+		fmt.Fprintf(w, "test_server_request_duration_seconds_count{%v} %v\n", labels, stat.requests)
+	}
+
+	fmt.Fprintln(w, "# HELP test_server_response_status Responses sent by the test server by status code.")
+	fmt.Fprintln(w, "# TYPE test_server_response_status counter")
+	for _, route := range routes {
+		codes := make([]int, 0, len(rs.statuses[route]))
+		for code := range rs.statuses[route] {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+
+		for _, code := range codes {
+			fmt.Fprintf(w, "test_server_response_status{%v,code=\"%v\"} %v\n", prometheusLabels(route), code, rs.statuses[route][code])
+		}
+	}
+}
+
+func (s *_Server) writePrometheusMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	s.routeStats.writePrometheus(w)
+}
+
+func prometheusLabels(route _Route) string {
+	return fmt.Sprintf("method=\"%v\",key=\"%v\"", prometheusEscape(route.Method), prometheusEscape(route.Key))
+}
+
+func prometheusEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
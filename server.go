@@ -1,15 +1,109 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/golang/protobuf/proto"
 )
 
+var supportedMethods = []string{
+	http.MethodGet,
+	http.MethodPatch,
+	http.MethodPost,
+	http.MethodTrace,
+}
+
+const requestIDHeader = "X-Request-Id"
+
 // Server responds to HTTP requests
 type Server interface {
+	// AssertGETRequestMade fails t if the given key
+	// didn't receive a GET request
+	AssertGETRequestMade(t testing.TB, key string)
+
+	// AssertNoGETRequests fails t for every key
+	// that received a GET request
+	AssertNoGETRequests(t testing.TB)
+
+	// AssertNoPOSTRequests fails t for every key
+	// that received a POST request
+	AssertNoPOSTRequests(t testing.TB)
+
+	// AssertNoPanics waits for the assertions set with
+	// SetGETResponseBodyAndAssert to finish and fails t
+	// for every one of them that panicked
+	AssertNoPanics(t testing.TB)
+
+	// AssertNoRequests fails t for every method
+	// and key that received a request
+	AssertNoRequests(t testing.TB)
+
+	// AssertPATCHRequestMade fails t if the given key
+	// didn't receive a PATCH request
+	AssertPATCHRequestMade(t testing.TB, key string)
+
+	// AssertPOSTRequestMade fails t if the given key
+	// didn't receive a POST request
+	AssertPOSTRequestMade(t testing.TB, key string)
+
+	// AssertRequestBodyEquals fails t unless the body of the
+	// index-th request for the given method and key equals
+	// expected. JSON bodies are compared ignoring formatting
+	// and field order
+	AssertRequestBodyEquals(t testing.TB, method, key string, index int, expected string)
+
+	// AssertRequestMade fails t if the given method
+	// and key didn't receive a request
+	AssertRequestMade(t testing.TB, method, key string)
+
+	// ClearAllRequests removes every recorded request
+	// while keeping the responses
+	ClearAllRequests()
+
+	// ClearGETRequests removes the recorded GET requests for
+	// the given key where key is "path?query"
+	ClearGETRequests(key string)
+
+	// ClearPOSTRequests removes the recorded POST requests
+	// for the given key where key is "path?query <file content>"
+	ClearPOSTRequests(key string)
+
 	// Close shuts the server down. If Close has already
 	// been called, or Open was never called, then Close
 	// is a noop. This method returns an error type
@@ -17,162 +111,3509 @@ type Server interface {
 	// will always be nil
 	Close() error
 
-	// GetGETRequests retrieves requests for
+	// GenerateRequestIDs makes the server set an X-Request-Id
+	// header with a random UUID on requests that arrive without
+	// one, and send the request id back in the response
+	GenerateRequestIDs(generate bool)
+
+	// GetAbortedRequestCount returns the number of connections
+	// closed on purpose for the given method and key because
+	// of SetGETResponseCancelContext
+	GetAbortedRequestCount(method, key string) int
+
+	// GetAllRegisteredKeys returns the sorted keys that have a
+	// response set for the given method
+	GetAllRegisteredKeys(method string) []string
+
+	// GetAllRegisteredRoutes returns the keys of
+	// GetAllRegisteredKeys for every method that has any
+	GetAllRegisteredRoutes() map[string][]string
+
+	// GetAverageResponseLatency returns the mean of
+	// GetResponseLatency over every request for the
+	// given method and key, or 0 if there are none
+	GetAverageResponseLatency(method, key string) time.Duration
+
+	// GetDuplicateRequests groups requests for the given method
+	// and key that have the same body and arrived within the
+	// duplicate window (see WithDuplicateWindow) of the first
+	// request of the group. Only groups with duplicates are returned
+	GetDuplicateRequests(method, key string) []DuplicateGroup
+
+	// GetGETRequest returns the index-th request for the
+	// given key where key is "path?query", or false if
+	// there is no such request
+	GetGETRequest(key string, index int) (*http.Request, bool)
+
+	// GetGETRequests retrieves a copy of the requests for
 	// the given key where key is "path?query"
+	// it is safe to call while requests are being served
 	GetGETRequests(key string) []http.Request
 
+	// GetGeneratedResponses returns the bodies produced by the
+	// generator set with SetGETResponseBodyGenerator for the
+	// given key, in the order they were served
+	GetGeneratedResponses(key string) []string
+
+	// GetIdempotencyKeyReuses returns the number of requests for
+	// the given method and key that reused an idempotency key
+	// (see SetIdempotencyKeyHeader)
+	GetIdempotencyKeyReuses(method, key string) int
+
+	// GetLatencyHistogram returns the distribution of the time
+	// taken to serve the completed requests for the given method
+	// and key. It is the zero value if none have completed
+	GetLatencyHistogram(method, key string) LatencyHistogram
+
+	// GetMaxConcurrentRequests returns the highest number of
+	// requests observed in flight at once for the given method
+	// and key. Only keys with a concurrency limit are tracked
+	GetMaxConcurrentRequests(method, key string) int
+
+	// GetMetrics returns a summary of the requests received
+	// and responses sent since the last Reset
+	GetMetrics() ServerMetrics
+
+	// GetPATCHRequests retrieves requests for
+	// the given key where key is "path?query body"
+	// body is the request body, normalized if it is JSON
+	GetPATCHRequests(key string) []http.Request
+
+	// GetPOSTBodyXML unmarshals the body of the index-th
+	// request for the given key where key is "path?query body"
+	// into v using encoding/xml
+	GetPOSTBodyXML(key string, index int, v interface{}) error
+
+	// GetPOSTFiles returns every file uploaded in the index-th
+	// request for the given key where key is "path?query body",
+	// in the order they were sent
+	GetPOSTFiles(key string, index int) []FormFile
+
+	// GetPOSTMultipartFiles returns the files uploaded in the
+	// index-th request for the given key where key is
+	// "path?query body", mapped from form field name to content
+	GetPOSTMultipartFiles(key string, index int) map[string][]byte
+
+	// GetPOSTRequest returns the index-th request for the
+	// given key where key is "path?query body", or false
+	// if there is no such request
+	GetPOSTRequest(key string, index int) (*http.Request, bool)
+
 	// GetPOSTRequests retrieves requests for
 	// for the given key where key is "path?query body"
 	// body is expected to be an Multipart Post body with
-	// a file named "file"
+	// a file named "file" (see SetPOSTFormFieldName)
 	GetPOSTRequests(key string) []http.Request
 
-	// Open starts the server
+	// GetQuotaExceededCount returns the number of HTTP 429
+	// responses sent for the given method and key because
+	// of SetMaxRequests
+	GetQuotaExceededCount(method, key string) int
+
+	// GetRedirectHopCount returns the number of redirects set
+	// with SetGETRedirectSequence for the given key before the
+	// final response, or 0 if there is no sequence for key
+	GetRedirectHopCount(key string) int
+
+	// GetRequestBodyHash returns the hex encoded SHA256 of the
+	// body of the index-th request for the given method and key,
+	// or "" if there is no such request
+	GetRequestBodyHash(method, key string, index int) string
+
+	// GetRequestByID returns the recorded request whose
+	// X-Request-Id header equals id, or false if there is no
+	// such request
+	GetRequestByID(id string) (*http.Request, bool)
+
+	// GetRequestCount returns the number of requests received,
+	// across all methods and keys, since the last Reset. Health
+	// checks, metrics scrapes and requests an interceptor
+	// answers are counted too
+	GetRequestCount() int
+
+	// GetRequestCountByMethod returns the number of requests
+	// received for the given method since the last Reset
+	GetRequestCountByMethod(method string) int
+
+	// GetRequestURL returns the fully qualified url of the
+	// index-th request for the given method and key, or nil
+	// if there is no such request
+	GetRequestURL(method, key string, index int) *url.URL
+
+	// GetRequestsByUserAgent returns the requests for the given
+	// method and key whose User-Agent is ua or starts with it
+	GetRequestsByUserAgent(method, key, ua string) []http.Request
+
+	// GetRequestsInOrder returns every request for the given
+	// method, across all keys, in the order they arrived
+	GetRequestsInOrder(method string) []OrderedRequest
+
+	// GetResponseBodyFor returns the body and status code of the
+	// response set for the given method and key, or false if
+	// there is no such response
+	GetResponseBodyFor(method, key string) (body string, statusCode int, found bool)
+
+	// GetResponseLatency returns the time between the index-th
+	// request for the given method and key reaching the server
+	// and the last write of its response, or 0 if there is no
+	// such request
+	GetResponseLatency(method, key string, index int) time.Duration
+
+	// GetServerAddress returns the host and port the server
+	// is listening on, as found in URL
+	GetServerAddress() (host string, port int, err error)
+
+	// GetTRACERequests retrieves a copy of the TRACE requests
+	// for the given key where key is "path?query"
+	// (see SetTRACEEnabled)
+	GetTRACERequests(key string) []http.Request
+
+	// IsOpen reports whether the server has been opened
+	// and not closed since
+	IsOpen() bool
+
+	// LoadCassette registers the responses of c for the keys
+	// they were recorded for. Keys recorded more than once
+	// respond with their responses in turn, as with
+	// SetResponseRoundRobin
+	LoadCassette(c Cassette)
+
+	// LoadRequests replaces the request log with the requests
+	// saved to path by PersistRequests. The server does not need
+	// to be open. Loaded requests are available through RequestLog
+	LoadRequests(path string) error
+
+	// MaxConcurrency returns the highest number of requests
+	// observed in flight at once since the last Reset
+	MaxConcurrency() int
+
+	// MustClose calls Close and panics if it fails
+	MustClose()
+
+	// MustOpen calls Open and panics if it fails, for
+	// setup code that has no testing.T such as TestMain
+	MustOpen()
+
+	// Open starts the server. Servers constructed
+	// by NewTLS serve HTTPS
 	Open() error
 
+	// OpenTLS starts the server serving HTTPS. Unless
+	// the server was constructed by NewTLS it uses the
+	// certificate generated by httptest (see TLSCert)
+	OpenTLS() error
+
+	// PersistRequests writes every request in the request log,
+	// as returned by RequestLog, to path as JSON
+	PersistRequests(path string) error
+
+	// RecordedResponseFor returns the response that was sent
+	// for the index-th request for the given method and key,
+	// or nil if there is no such request
+	RecordedResponseFor(method, key string, index int) *httptest.ResponseRecorder
+
+	// RegisterMatcher adds m to the matchers consulted, in the
+	// order they were registered, to resolve the key of requests
+	// for the given method. Requests no matcher matches are keyed
+	// as usual. Matchers are kept by Reset
+	RegisterMatcher(method string, m Matcher)
+
+	// RemoveHeaderForwardingRule removes the rule added
+	// by SetHeaderForwardingRule for srcHeader
+	RemoveHeaderForwardingRule(srcHeader string)
+
+	// RemoveRequiredHeader removes the requirement
+	// added by RequireHeader for header
+	RemoveRequiredHeader(header string)
+
+	// RequestLog returns every request received since the
+	// last Reset in the order they arrived
+	RequestLog() []RequestLogEntry
+
+	// RequestsSince returns the requests received at or
+	// after t in the order they arrived
+	RequestsSince(t time.Time) []RequestLogEntry
+
+	// RequireHeader makes the server respond with an HTTP 400
+	// to every request whose header doesn't have the given
+	// value. Every required header must be present
+	RequireHeader(header, value string)
+
 	// Reset clears all requests and responses. This
 	// should be called between every test to prevent
-	// tests from affecting each other.
+	// tests from affecting each other. Server-wide
+	// settings, such as interceptors, are kept.
+	// It waits for requests being served to choose their
+	// response, so it is safe to call while requests are in
+	// flight, but it deadlocks if called from an interceptor
+	// or a response callback. Responses set with
+	// SetResponseStreamFrom don't hold it off while streaming,
+	// but GET request timeouts do for up to their duration
 	Reset()
 
+	// Serve starts the server on l instead of a listener
+	// created by httptest, using TLS if the server was
+	// constructed by NewTLS. The server closes l on Close
+	Serve(l net.Listener) error
+
+	// ServeHTTP handles r like a request received by the
+	// server, which lets the server be used as an http.Handler
+	// without calling Open
+	ServeHTTP(w http.ResponseWriter, r *http.Request)
+
+	// SetAlwaysResponse sets the response for every request
+	// that has no other response, instead of an HTTP 404. This
+	// includes POST requests without a multipart file and
+	// requests of methods the server has no responses for
+	SetAlwaysResponse(statusCode int, contentType, body string)
+
+	// SetConcurrencyLimit makes the server respond with an
+	// HTTP 503 and Retry-After: 1 to requests for the given
+	// method and key while maxConcurrent of them are in flight
+	SetConcurrencyLimit(method, key string, maxConcurrent int)
+
+	// SetContentTypeForKey overrides the Content-Type of the
+	// responses for the given method and key, leaving their
+	// body and status code unchanged
+	SetContentTypeForKey(method, key, contentType string)
+
+	// SetDefaultResponseHeaders adds headers to every response.
+	// Headers set for a route replace the default headers with
+	// the same name. Default headers are kept by Reset
+	SetDefaultResponseHeaders(headers http.Header)
+
+	// SetEchoHandler makes requests for the given method and
+	// path respond with their own body. The response will
+	// be an HTTP 200 with the same Content-Type as the request.
+	// Requests are recorded with the key "path?query" whatever
+	// their method or Content-Type
+	SetEchoHandler(method, path string)
+
+	// SetExpectAtLeast makes VerifyAllExpectations fail unless
+	// the given method and key received at least n requests
+	SetExpectAtLeast(method, key string, n int)
+
+	// SetExpectAtMost makes VerifyAllExpectations fail unless
+	// the given method and key received at most n requests
+	SetExpectAtMost(method, key string, n int)
+
+	// SetExpectExactly makes VerifyAllExpectations fail unless
+	// the given method and key received exactly n requests
+	SetExpectExactly(method, key string, n int)
+
+	// SetGETJSONPResponse sets the response for the given key
+	// where key is "path?query" without the callbackParam query
+	// parameter. When callbackParam is present the response is
+	// "callback(body)" with Content-Type application/javascript,
+	// otherwise it is body with Content-Type application/json.
+	// Either way the response is an HTTP 200
+	SetGETJSONPResponse(key, callbackParam, body string)
+
+	// SetGETPagedResponse sets pages[i-1] as the HTTP 200 response
+	// for the given key where key is "path?query" without the
+	// pageQueryParam query parameter when it is i. Requests
+	// without pageQueryParam get the first page, and requests for
+	// pages after the last one get an empty array
+	SetGETPagedResponse(key string, pages []string, pageQueryParam string)
+
+	// SetGETRedirectSequence makes the given key where key is
+	// "path?query" redirect with an HTTP 302 to hops[0], each hop
+	// redirect to the next and the last hop respond with
+	// finalStatusCode and finalBody. Hops are "path" or
+	// "path?query" and are used as the Location header
+	SetGETRedirectSequence(key string, hops []string, finalStatusCode int, finalBody string)
+
+	// SetGETRequestTimeout makes GET requests for the given key
+	// where key is "path?query" receive an HTTP 503 with a
+	// timeout message when responding takes longer than d, the
+	// same way as http.TimeoutHandler
+	SetGETRequestTimeout(key string, d time.Duration)
+
+	// SetGETResponseAfterDelay sets r as the response for the
+	// given key where key is "path?query" once delay has passed
+	// since the server was opened. Until then the key is handled
+	// as if r was never set, which usually means an HTTP 404
+	SetGETResponseAfterDelay(key string, delay time.Duration, r Response)
+
+	// SetGETResponseAutoCompress makes the response for the given
+	// key where key is "path?query" be compressed with the best
+	// encoding the request accepts in its Accept-Encoding header,
+	// gzip and then deflate, and sets Vary: Accept-Encoding
+	SetGETResponseAutoCompress(key string, enabled bool)
+
 	// SetGETResponse sets the string response
 	// for the given key where key is "path?query"
+	// The response will be an HTTP 200 unless a status
+	// code is given. The Content-Type will be
+	// application/json
+	SetGETResponseBody(key, body string, statusCode ...int)
+
+	// SetGETResponseBodyAndAssert sets the response like
+	// SetGETResponseBody and runs every assertion with each
+	// request for the key in its own goroutine. Panics are
+	// reported by AssertNoPanics
+	SetGETResponseBodyAndAssert(key, body string, assertions ...func(*http.Request))
+
+	// SetGETResponseBodyBase64 decodes base64Body and sets the
+	// bytes as the response for the given key where key is
+	// "path?query" with the given status code and content type
+	SetGETResponseBodyBase64(key string, statusCode int, contentType, base64Body string) error
+
+	// SetGETResponseBodyBytes sets body as the response for the
+	// given key where key is "path?query" with the given status
+	// code and content type. body is written unchanged
+	SetGETResponseBodyBytes(key string, statusCode int, contentType string, body []byte)
+
+	// SetGETResponseBodyFromTemplate renders the text/template
+	// tmplStr with data once and sets the result as the response
+	// body like SetGETResponseBody
+	SetGETResponseBodyFromTemplate(key, tmplStr string, data interface{}) error
+
+	// SetGETResponseBodyGenerator makes the server call gen for
+	// every request for the given key where key is "path?query"
+	// and respond with the result as an HTTP 200 and Content-Type
+	// application/json. Generated bodies are kept for
+	// GetGeneratedResponses
+	SetGETResponseBodyGenerator(key string, gen func() string)
+
+	// SetGETResponseBodyHex decodes hexBody and sets the bytes
+	// as the response for the given key where key is
+	// "path?query" with the given status code and content type
+	SetGETResponseBodyHex(key string, statusCode int, contentType, hexBody string) error
+
+	// SetGETResponseBodyJSON sets v encoded as JSON as the
+	// response for the given key where key is "path?query".
+	// The response will be an HTTP 200 and Content-Type
+	// application/json
+	SetGETResponseBodyJSON(key string, v interface{}) error
+
+	// SetGETResponseBodyTransformer sets fn to rewrite the body
+	// of the response for GET requests for the given key where
+	// key is "path?query" before it is written, given the body
+	// and the request, for example to fill in query parameters
+	SetGETResponseBodyTransformer(key string, fn func(body string, r *http.Request) string)
+
+	// SetGETResponseCancelContext makes GET requests for the given
+	// key where key is "path?query" receive only the first
+	// afterBytes of the response body before the connection is
+	// closed, so the client sees an incomplete response
+	SetGETResponseCancelContext(key string, afterBytes int)
+
+	// SetGETResponseDependsOn makes GET requests for the given key
+	// where key is "path?query" receive an HTTP 412 until a GET
+	// request for requiredKey has been made. Every dependency set
+	// for key is required
+	SetGETResponseDependsOn(key string, requiredKey string)
+
+	// SetGETResponseForRemoteAddr sets r as the response for GET
+	// requests for the given key where key is "path?query" whose
+	// remote address, with or without the port, is addr
+	SetGETResponseForRemoteAddr(key, addr string, r Response)
+
+	// SetGETResponseForUserAgent sets r as the response for GET
+	// requests for the given key where key is "path?query" whose
+	// User-Agent is userAgent or starts with it. The longest
+	// matching userAgent wins. It is only used when no other
+	// response is set for the key
+	SetGETResponseForUserAgent(key, userAgent string, r Response)
+
+	// SetGETResponseFromHTTPResponse sets the status code,
+	// headers and body of resp as the response for the given
+	// key where key is "path?query". The body of resp is
+	// read and closed
+	SetGETResponseFromHTTPResponse(key string, resp *http.Response) error
+
+	// SetGETResponseGzip sets the gzip compressed body as the
+	// response for the given key where key is "path?query" with
+	// Content-Encoding gzip whether or not the client sent
+	// Accept-Encoding. The response will be an HTTP 200 and
+	// Content-Type application/json
+	SetGETResponseGzip(key, body string)
+
+	// SetGETResponseOnCondition adds a response for GET requests
+	// for the given key where key is "path?query" that is used
+	// when cond returns true. Conditions are tried in the order
+	// they were added, before any other response for the key
+	SetGETResponseOnCondition(key string, cond func(*http.Request) bool, r Response)
+
+	// SetGETResponseOnce sets r as the response for the first GET
+	// request for the given key where key is "path?query". It is
+	// removed once served and later requests get the response
+	// that would otherwise be used for the key
+	SetGETResponseOnce(key string, r Response)
+
+	// SetGETXMLResponse sets the string response
+	// for the given key where key is "path?query"
 	// The response will automatically be an HTTP 200
-	// and Content-Type application/json
-	SetGETResponseBody(key, body string)
+	// and Content-Type application/xml
+	SetGETXMLResponse(key, body string)
+
+	// SetGRPCTranscodingResponse sets the response for POST
+	// requests to the transcoded gRPC method protoMethod, given
+	// as "/package.Service/Method", whose JSON body is equivalent
+	// to requestProto. The response body is responseProto as JSON
+	// with Content-Type application/json
+	SetGRPCTranscodingResponse(protoMethod string, requestProto proto.Message, statusCode int, responseProto proto.Message) error
+
+	// SetHMACSigning makes the server reject requests with an
+	// HTTP 403 unless headerName holds the hex encoded HMAC of
+	// the request body using secret. algorithm is one of "sha1",
+	// "sha256" or "sha512". A nil secret disables verification
+	SetHMACSigning(secret []byte, headerName string, algorithm string) error
+
+	// SetHeaderForwardingRule makes the server copy the value
+	// of srcHeader in requests to dstHeader in responses for
+	// every route. Rules are kept by Reset
+	SetHeaderForwardingRule(srcHeader, dstHeader string)
+
+	// SetHealthCheck makes path respond to every request with
+	// an HTTP 200 and {"status":"ok"} regardless of any other
+	// configuration. Unlike other responses it survives Reset
+	SetHealthCheck(path string)
+
+	// SetIdempotencyKeyHeader makes the server track the values
+	// of headerName. A request reusing a value already seen
+	// since the last Reset gets an HTTP 409, or the first
+	// response again if SetIdempotencyKeyReplay is enabled.
+	// Reuses while the first request is being served always
+	// get an HTTP 409. An empty headerName disables tracking
+	SetIdempotencyKeyHeader(headerName string)
+
+	// SetIdempotencyKeyReplay sets whether requests reusing an
+	// idempotency key get the first response again instead of
+	// an HTTP 409
+	SetIdempotencyKeyReplay(replay bool)
+
+	// SetMaxRequests makes the server respond with an HTTP 429
+	// to every request for the given method and key after the
+	// first n
+	SetMaxRequests(method, key string, n int)
+
+	// SetPATCHMergePatchResponse sets the response for PATCH
+	// requests to path whose body is the JSON Merge Patch
+	// expectedPatch. Both expectedPatch and request bodies are
+	// normalized, so field ordering and whitespace don't matter.
+	// path may include a query as "path?query"
+	SetPATCHMergePatchResponse(path string, expectedPatch interface{}, statusCode int, body string) error
+
+	// SetPOSTFormFieldName sets the name of the multipart
+	// field whose file is used as the body portion of POST
+	// keys. An empty fieldName restores the default "file"
+	SetPOSTFormFieldName(fieldName string)
 
 	// SetPOSTResponseBody sets the string response
 	// for the given key where key is "path?query body"
 	// body is expected to be an Multipart Post body with
-	// a file named "file". The response will automatically
-	// be an HTTP 200 and Content-Type application/json
+	// a file named "file" (see SetPOSTFormFieldName). Use
+	// POSTMultipartKey to compute
+	// the key of uploads with more than one file. The response
+	// will automatically be an HTTP 200 and Content-Type
+	// application/json
 	SetPOSTResponseBody(key, body string)
 
+	// SetPOSTResponseBodyForContentType sets body with the given
+	// status code as the response like SetPOSTResponseByContentType,
+	// where key is "path?query"
+	SetPOSTResponseBodyForContentType(key, contentType string, statusCode int, body string)
+
+	// SetPOSTResponseBodyJSON sets v encoded as JSON as the
+	// response like SetPOSTResponseBody. Use POSTKeyFromJSON to
+	// compute the key of requests that upload a JSON file
+	SetPOSTResponseBodyJSON(key string, v interface{}) error
+
+	// SetPOSTResponseByContentType sets the response for POST
+	// requests for the given key where key is "path?query"
+	// whose Content-Type, without parameters, is contentType.
+	// Such requests are recorded under key whatever their body.
+	// Requests with other content types get the response set
+	// by SetPOSTResponseBody, if any
+	SetPOSTResponseByContentType(key string, contentType string, r Response)
+
+	// SetPrometheusMetricsPath makes path serve Prometheus text
+	// format metrics of the requests received since the last
+	// Reset: test_server_requests_total, the histogram
+	// test_server_request_duration_seconds and
+	// test_server_response_status, labelled by method and key.
+	// An empty path disables the endpoint
+	SetPrometheusMetricsPath(path string)
+
+	// SetRemoteAddrOverride makes every request appear to come
+	// from addr, as seen in Request.RemoteAddr. An empty addr
+	// removes the override
+	SetRemoteAddrOverride(addr string)
+
+	// SetRequestBodyMatcher adds matcher for requests for the
+	// given method and key. A request whose path and query match
+	// those of key and whose body any of the matchers for key
+	// returns true for is served and recorded as key
+	SetRequestBodyMatcher(method, key string, matcher func([]byte) bool)
+
+	// SetRequestSizeLimit makes the server respond with an HTTP
+	// 413 to every request whose body is larger than maxBytes,
+	// before its key is computed. A maxBytes of 0 removes the limit
+	SetRequestSizeLimit(maxBytes int64)
+
+	// SetRequestSizeLimitForKey makes the server respond with an
+	// HTTP 413 to requests for the given method and key whose
+	// body is larger than maxBytes
+	SetRequestSizeLimitForKey(method, key string, maxBytes int64)
+
+	// SetRequestTransformer sets fn to modify a copy of every
+	// request before its key is computed, for example to strip
+	// a header or body field that varies between calls. The
+	// original request is the one recorded. If fn returns nil
+	// the request is keyed as is. A nil fn removes it
+	SetRequestTransformer(fn func(r *http.Request) *http.Request)
+
+	// SetResponseAfterRequests sets r as the response for every
+	// request for the given method and key after the first
+	// after requests, which get the usual response
+	SetResponseAfterRequests(method, key string, after int, r Response)
+
+	// SetResponseBodyFromEnv sets the value of the environment
+	// variable envVar as the response body for the given method
+	// and key, with an HTTP 200. It returns an error if the
+	// variable is empty
+	SetResponseBodyFromEnv(method, key string, envVar string) error
+
+	// SetResponseCallback sets fn to be called with the request
+	// and a copy of the matched response for the given method and
+	// key just before the response is written. fn may modify the
+	// response, which only affects the current request
+	SetResponseCallback(method, key string, fn func(req *http.Request, resp *Response))
+
+	// SetResponseForRequestCount sets r as the response for the
+	// count-th request, counting from 1, for the given method
+	// and key. Other requests get the usual response
+	SetResponseForRequestCount(method, key string, count int, r Response)
+
+	// SetResponseFromFixtureDir walks dir and registers every
+	// file as the response for method requests to basePath
+	// joined with the file's path relative to dir without its
+	// extension, so users/list.json becomes basePath/users/list.
+	// The content type is taken from the file extension
+	SetResponseFromFixtureDir(method, basePath, dir string) error
+
+	// SetResponseInterceptor adds fn around the handling of
+	// every request. fn must call next to route the request
+	// as usual. The first interceptor added is the outermost
+	SetResponseInterceptor(fn func(w http.ResponseWriter, r *http.Request, next func()))
+
+	// SetResponseRoundRobin cycles through the given responses
+	// for the given method and key, returning the next one
+	// on every request and starting over after the last
+	SetResponseRoundRobin(method, key string, responses []Response)
+
+	// SetResponseStreamFrom makes GET requests for the given
+	// key where key is "path?query" respond with an HTTP 200 whose
+	// body is copied from r, flushing as data becomes available.
+	// The response ends when r returns io.EOF, for example when
+	// the writing side of an io.Pipe is closed. r is only read once
+	SetResponseStreamFrom(key string, r io.Reader, contentType string)
+
+	// SetSlowStart delays only the first response for
+	// the given method and key by delay
+	SetSlowStart(method, key string, delay time.Duration)
+
+	// SetTRACEEnabled turns handling of TRACE requests on or off.
+	// When on, TRACE requests are recorded and answered with the
+	// request line and headers as Content-Type message/http
+	SetTRACEEnabled(enabled bool)
+
+	// SetupFromJSON registers the responses described by data,
+	// which uses the same schema as SetupFromYAML
+	SetupFromJSON(data []byte) error
+
+	// SetupFromOpenAPISpec registers a stub response for every
+	// GET operation in the given OpenAPI 3 JSON or YAML document,
+	// using the first 2xx response. Bodies come from the example
+	// of the application/json content, or are generated from
+	// its schema. Templated paths such as /users/{id} match any
+	// value of their parameters, except for paths that have a
+	// response of their own, until Reset. Other methods are
+	// skipped since their keys depend on the request body
+	SetupFromOpenAPISpec(spec []byte) error
+
+	// SetupFromYAML registers the responses described by data:
+	//
+	//   routes:
+	//     - method: POST
+	//       path: /upload?type=csv
+	//       body: a,b,c
+	//       status: 201
+	//       contentType: application/json
+	//       response: '{"id":1}'
+	//
+	// path is "path?query". body is the body portion of the
+	// key for POST and PATCH routes. status defaults to 200
+	SetupFromYAML(data []byte) error
+
+	// StartRecording makes the server forward every request to
+	// upstreamURL and respond with the upstream response, which
+	// is recorded together with the request key. Requests that
+	// have no key of their method, like PUT requests or POST
+	// requests without a multipart file, are keyed
+	// "path?query body" with their raw body
+	StartRecording(upstreamURL string) error
+
+	// StopRecording stops forwarding requests and returns the
+	// interactions recorded since StartRecording
+	StopRecording() Cassette
+
+	// TLSCert returns the PEM encoded certificate the server
+	// uses for HTTPS, for clients to trust
+	TLSCert() ([]byte, error)
+
+	// UnsetAlwaysResponse removes the response set by
+	// SetAlwaysResponse, restoring the HTTP 404
+	UnsetAlwaysResponse()
+
+	// UnsetHealthCheck removes the path set by SetHealthCheck
+	UnsetHealthCheck()
+
 	// URL returns the url where the server can be found
 	URL() *url.URL
+
+	// VerifyAllExpectations fails t for every response set for
+	// a method and key that didn't receive a request, and for
+	// every expectation set with SetExpectAtLeast, SetExpectAtMost
+	// or SetExpectExactly that wasn't met
+	VerifyAllExpectations(t testing.TB)
 }
 
 type _Server struct {
-	server *httptest.Server
-	url    *url.URL
+	server         *httptest.Server
+	url            *url.URL
+	logger         *log.Logger
+	tlsCertificate *tls.Certificate
+	openedAt       time.Time
+
+	defaultResponseHeaders http.Header
+	duplicateWindow        time.Duration
+	generateRequestIDs     bool
+	getKeyFunc             func(r *http.Request, body []byte) string
+	grpcTranscodingMatcher *_GRPCTranscodingMatcher
+	headerForwardingRules  map[string]string
+	healthCheckPath        string
+	hmacSigning            *_HMACSigning
+	idempotencyKeyHeader   string
+	idempotencyKeyReplay   bool
+	interceptors           []func(w http.ResponseWriter, r *http.Request, next func())
+	matchers               map[string][]Matcher
+	openAPIMatcher         *_OpenAPIMatcher
+	postFormFieldName      string
+	postKeyFunc            func(r *http.Request, body []byte) string
+	prometheusMetricsPath  string
+	readTimeout            time.Duration
+	recording              *_Recording
+	remoteAddrOverride     string
+	requiredHeaders        map[string]string
+	requestSizeLimit       int64
+	requestTransformer     func(r *http.Request) *http.Request
+	traceEnabled           bool
+
+	httpGETRequests    map[string][]http.Request
+	httpGETResponses   map[string]Response
+	httpPATCHRequests  map[string][]http.Request
+	httpPATCHResponses map[string]Response
+	httpPOSTRequests   map[string][]http.Request
+	httpPOSTResponses  map[string]Response
+	httpTRACERequests  map[string][]http.Request
+
+	assertionMutex        sync.Mutex
+	assertionPanics       []string
+	assertionWaitGroup    sync.WaitGroup
+	inFlight              int64
+	maxInFlight           int64
+	metrics               *_Metrics
+	onceMutex             sync.Mutex
+	requestCount          int64
+	requestCountsByMethod *sync.Map
+	requestLog            []RequestLogEntry
+	requestsMutex         sync.RWMutex
+	resetMutex            sync.RWMutex
+	routeStats            *_RouteStats
+
+	abortAfterBytes      map[string]int
+	abortedRequests      map[_Route]int
+	afterResponses       map[_Route]_AfterResponse
+	alwaysResponse       *Response
+	assertions           map[string][]func(*http.Request)
+	autoCompress         map[string]bool
+	bodyMatchers         map[_Route][]func([]byte) bool
+	bodyTransformers     map[string]func(body string, r *http.Request) string
+	concurrencyLimits    map[_Route]*_ConcurrencyLimit
+	conditionalResponses map[string][]_ConditionalResponse
+	contentTypeResponses map[string]map[string]Response
+	contentTypes         map[_Route]string
+	countResponses       map[_Route]map[int]Response
+	delayedResponses     map[string]_DelayedResponse
+	dependencies         map[string][]string
+	echoHandlers         map[_Route]bool
+	expectations         map[_Route]*_Expectation
+	generatedResponses   map[string][]string
+	generators           map[string]func() string
+	idempotencyKeyReuses map[_Route]int
+	// idempotencyResponses holds a nil recorder for
+	// values whose first request is still being served
+	idempotencyResponses map[string]*httptest.ResponseRecorder
+	jsonpResponses       map[string]_JSONPResponse
+	onceResponses        map[string]Response
+	pagedResponses       map[string]_PagedResponse
+	quotas               map[_Route]*_Quota
+	recordedResponses    map[_Route][]*_ResponseWriter
+	redirectHops         map[string]int
+	remoteAddrResponses  map[string]map[string]Response
+	requestSizeLimits    map[_Route]int64
+	requestTimeouts      map[string]time.Duration
+	responseCallbacks    map[_Route]func(req *http.Request, resp *Response)
+	roundRobins          map[_Route]*_RoundRobin
+	slowStarts           map[_Route]*_SlowStart
+	streams              map[string]_Stream
+	userAgentResponses   map[string]map[string]Response
+}
+
+type _ConcurrencyLimit struct {
+	inFlight    int64
+	maxInFlight int64
+	semaphore   chan struct{}
+}
+
+// Matcher resolves the key of a request. Matchers registered
+// with RegisterMatcher replace the default key computation
+// for their method whenever they match
+type Matcher interface {
+	Match(r *http.Request) (key string, ok bool)
+}
+
+// DefaultMatcher matches every request with the key
+// "path?query". It keys GET requests no registered
+// matcher matches, and prefixes PATCH and POST keys
+type DefaultMatcher struct{}
+
+func (DefaultMatcher) Match(r *http.Request) (string, bool) {
+	return r.URL.Path + "?" + r.URL.RawQuery, true
+}
+
+// PathParamsMatcher is a Matcher that also captures the
+// dynamic segments of the path, such as the id in
+// /users/{id}, which can then be read with GetPathParam
+type PathParamsMatcher interface {
+	Matcher
+	PathParams(r *http.Request) map[string]string
+}
+
+type pathParamsKey struct{}
+
+type releaseResetKey struct{}
+
+// DuplicateGroup is a request along with the requests
+// that appear to duplicate it
+type DuplicateGroup struct {
+	First      http.Request
+	Duplicates []http.Request
+	// Gap is the time between First and the last duplicate
+	Gap time.Duration
+}
+
+// FormFile is a file uploaded in a multipart request
+type FormFile struct {
+	FieldName   string
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+type _Expectation struct {
+	atLeast int
+	// atMost is negative when there is no upper bound
+	atMost int
+}
+
+type _HMACSigning struct {
+	secret     []byte
+	headerName string
+	hash       func() hash.Hash
+}
+
+type _SlowStart struct {
+	delay   time.Duration
+	started int32
+}
 
-	httpGETRequests   map[string][]http.Request
-	httpGETResponses  map[string]_Response
-	httpPOSTRequests  map[string][]http.Request
-	httpPOSTResponses map[string]_Response
+type _Stream struct {
+	reader      io.Reader
+	contentType string
 }
 
-type _Response struct {
-	StatusCode int
-	Body       string
+type _AfterResponse struct {
+	after    int
+	response Response
+}
+
+type _ConditionalResponse struct {
+	cond     func(*http.Request) bool
+	response Response
+}
+
+type _DelayedResponse struct {
+	delay    time.Duration
+	response Response
+}
+
+type _JSONPResponse struct {
+	callbackParam string
+	body          string
+}
+
+type _PagedResponse struct {
+	pageQueryParam string
+	pages          []string
+}
+
+type _Metrics struct {
+	bytesReceived     int64
+	bytesSent         int64
+	responses         int64
+	totalResponseTime int64
+}
+
+type _ResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	bodySize   int
+	recorder   *httptest.ResponseRecorder
+	// route is set once the request has been keyed
+	route       *_Route
+	startedAt   time.Time
+	completedAt time.Time
+	// mutex guards recorder and completedAt, which
+	// are read by getters while the handler writes
+	mutex sync.Mutex
+}
+
+type _Route struct {
+	Method string
+	Key    string
+}
+
+type _Quota struct {
+	maxRequests int64
+	requests    int64
+	exceeded    int64
+}
+
+type _RoundRobin struct {
+	index     uint64
+	responses []Response
+}
+
+// ServerMetrics summarizes the activity of a Server
+// since the last Reset
+type ServerMetrics struct {
+	TotalRequests       int
+	RequestsByMethod    map[string]int
+	BytesReceived       int64
+	BytesSent           int64
+	AverageResponseTime time.Duration
+}
+
+// LatencyHistogram summarizes the time taken to
+// serve the requests for a route
+type LatencyHistogram struct {
+	Min time.Duration
+	P50 time.Duration
+	P90 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// OrderedRequest is a request along with where
+// it was recorded and when it arrived
+type OrderedRequest struct {
+	http.Request
+	// Key is the key the request was recorded for
+	Key string
+	// Index is the position of the request among
+	// the requests recorded for Key
+	Index      int
+	ReceivedAt time.Time
+}
+
+// RequestLogEntry describes a request received by the Server
+type RequestLogEntry struct {
+	Method     string      `json:"method"`
+	Key        string      `json:"key"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	ReceivedAt time.Time   `json:"receivedAt"`
+}
+
+// Response describes what the Server replies
+// with for a matching request
+type Response struct {
+	StatusCode  int
+	ContentType string
+	Headers     http.Header
+	Body        string
 }
 
 // New constructs an instance of Server that uses
-// httptest
-func New() Server {
-	return &_Server{}
+// httptest, configured by the given options
+func New(opts ...Option) Server {
+	s := &_Server{
+		duplicateWindow: time.Second,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.Reset()
+	return s
 }
 
-func (s *_Server) Close() error {
-	if s.server == nil {
-		return nil
+// NewTLS constructs an instance of Server like New that
+// serves HTTPS using the given PEM encoded certificate
+// and private key once opened
+func NewTLS(certPEM, keyPEM []byte, opts ...Option) (Server, error) {
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
 	}
-	s.server.Close()
-	return nil
+
+	s := New(opts...).(*_Server)
+	s.tlsCertificate = &certificate
+	return s, nil
 }
 
-func (s *_Server) GetGETRequests(key string) []http.Request {
-	return s.httpGETRequests[key]
+// GetPathParam returns the path parameter name captured
+// for r by a PathParamsMatcher, or "" if there is none
+func GetPathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
 }
 
-func (s *_Server) GetPOSTRequests(key string) []http.Request {
-	return s.httpPOSTRequests[key]
+// POSTKeyFromJSON computes the POST key for a request to
+// path with the given raw query that uploads requestBody
+// encoded as JSON
+func POSTKeyFromJSON(path, query string, requestBody interface{}) (string, error) {
+	body, err := json.Marshal(requestBody)
+	if err != nil {
+		return "", err
+	}
+	return path + "?" + query + " " + string(body), nil
 }
 
-func (s *_Server) Open() error {
-	var err error
+// POSTMultipartKey computes the POST key for a multipart
+// request to pathAndQuery ("path?query") that uploads more
+// than one file. The body portion of the key is a hash of
+// every file, so it doesn't depend on the order of the parts
+func POSTMultipartKey(pathAndQuery string, files map[string][]byte) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	s.server = httptest.NewServer(http.HandlerFunc(s.handleRequest))
-	s.url, err = url.Parse(s.server.URL)
-	return err
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%d:%s%d:", len(name), name, len(files[name]))
+		h.Write(files[name])
+	}
+	return pathAndQuery + " " + hex.EncodeToString(h.Sum(nil))
 }
 
-func (s *_Server) Reset() {
-	s.httpGETResponses = map[string]_Response{}
-	s.httpPOSTResponses = map[string]_Response{}
+func (s *_Server) ClearAllRequests() {
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
 
 	s.httpGETRequests = map[string][]http.Request{}
+	s.httpPATCHRequests = map[string][]http.Request{}
 	s.httpPOSTRequests = map[string][]http.Request{}
+	s.httpTRACERequests = map[string][]http.Request{}
+	s.recordedResponses = map[_Route][]*_ResponseWriter{}
+	s.requestLog = nil
 }
 
-func (s *_Server) SetGETResponseBody(key, responseBody string) {
-	s.httpGETResponses[key] = _Response{
-		StatusCode: http.StatusOK,
-		Body:       responseBody,
-	}
+func (s *_Server) ClearGETRequests(key string) {
+	s.clearRequests(http.MethodGet, key)
 }
 
-func (s *_Server) SetPOSTResponseBody(key, responseBody string) {
-	s.httpPOSTResponses[key] = _Response{
-		StatusCode: http.StatusOK,
-		Body:       responseBody,
+func (s *_Server) ClearPOSTRequests(key string) {
+	s.clearRequests(http.MethodPost, key)
+}
+
+func (s *_Server) Close() error {
+	if s.server == nil {
+		return nil
 	}
+	s.server.Close()
+	s.server = nil
+	return nil
 }
 
-func (s *_Server) URL() *url.URL {
-	return s.url
+func (s *_Server) GenerateRequestIDs(generate bool) {
+	s.generateRequestIDs = generate
 }
 
-// privates
-func (s *_Server) handleRequest(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		s.handleGetRequest(w, r)
-		return
-	case http.MethodPost:
-		s.handlePostRequest(w, r)
-		return
+func (s *_Server) GetAbortedRequestCount(method, key string) int {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	return s.abortedRequests[_Route{Method: method, Key: key}]
+}
+
+func (s *_Server) GetAllRegisteredKeys(method string) []string {
+	keys := []string{}
+	for route := range s.registeredRoutes() {
+		if route.Method == method {
+			keys = append(keys, route.Key)
+		}
 	}
+	sort.Strings(keys)
+	return keys
 }
 
-func (s *_Server) handleGetRequest(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Path + "?" + r.URL.RawQuery
-	s.httpGETRequests[key] = append(s.httpGETRequests[key], *r)
+func (s *_Server) GetAllRegisteredRoutes() map[string][]string {
+	routes := map[string][]string{}
+	for _, method := range supportedMethods {
+		if keys := s.GetAllRegisteredKeys(method); len(keys) > 0 {
+			routes[method] = keys
+		}
+	}
+	return routes
+}
 
-	response, ok := s.httpGETResponses[key]
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("No httpGETResponse for '%v'", key)))
-		return
+func (s *_Server) GetAverageResponseLatency(method, key string) time.Duration {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	n := len(s.recordedResponses[_Route{Method: method, Key: key}])
+	if n == 0 {
+		return 0
 	}
 
-	w.WriteHeader(response.StatusCode)
-	w.Header().Add("Content-Type", "application/json")
-	w.Write([]byte(response.Body))
+	var total time.Duration
+	for _, rw := range s.recordedResponses[_Route{Method: method, Key: key}] {
+		latency, _ := rw.latency()
+		total += latency
+	}
+	return total / time.Duration(n)
 }
 
-func (s *_Server) handlePostRequest(w http.ResponseWriter, r *http.Request) {
-	f, _, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+func (s *_Server) GetDuplicateRequests(method, key string) []DuplicateGroup {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	requests := s.requestsFor(method)[key]
+
+	var entries []RequestLogEntry
+	for _, entry := range s.requestLog {
+		if entry.Method == method && entry.Key == key {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) > len(requests) {
+		entries = entries[:len(requests)]
 	}
 
-	body, err := ioutil.ReadAll(f)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	var groups []DuplicateGroup
+	grouped := make([]bool, len(entries))
+	for i, first := range entries {
+		if grouped[i] {
+			continue
+		}
+
+		group := DuplicateGroup{First: requests[i]}
+		for j := i + 1; j < len(entries); j++ {
+			gap := entries[j].ReceivedAt.Sub(first.ReceivedAt)
+			if gap > s.duplicateWindow {
+				break
+			}
+			if grouped[j] || !bytes.Equal(entries[j].Body, first.Body) {
+				continue
+			}
+
+			grouped[j] = true
+			group.Duplicates = append(group.Duplicates, requests[j])
+			group.Gap = gap
+		}
+
+		if len(group.Duplicates) > 0 {
+			groups = append(groups, group)
+		}
 	}
+	return groups
+}
 
-	key := r.URL.Path + "?" + r.URL.RawQuery + " " + string(body)
-	s.httpPOSTRequests[key] = append(s.httpPOSTRequests[key], *r)
+func (s *_Server) GetGETRequest(key string, index int) (*http.Request, bool) {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
 
-	response, ok := s.httpPOSTResponses[key]
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("No httpPOSTResponse for '%v'", key)))
-		return
+	return s.request(http.MethodGet, key, index)
+}
+
+func (s *_Server) GetGETRequests(key string) []http.Request {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	return s.requests(http.MethodGet, key)
+}
+
+func (s *_Server) GetGeneratedResponses(key string) []string {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	return append([]string{}, s.generatedResponses[key]...)
+}
+
+func (s *_Server) GetIdempotencyKeyReuses(method, key string) int {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	return s.idempotencyKeyReuses[_Route{Method: method, Key: key}]
+}
+
+func (s *_Server) GetLatencyHistogram(method, key string) LatencyHistogram {
+	s.requestsMutex.RLock()
+	var latencies []time.Duration
+	for _, rw := range s.recordedResponses[_Route{Method: method, Key: key}] {
+		if latency, ok := rw.latency(); ok {
+			latencies = append(latencies, latency)
+		}
+	}
+	s.requestsMutex.RUnlock()
+
+	if len(latencies) == 0 {
+		return LatencyHistogram{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	// nearest-rank percentile
+	percentile := func(p int) time.Duration {
+		rank := (p*len(latencies) + 99) / 100
+		return latencies[rank-1]
+	}
+	return LatencyHistogram{
+		Min: latencies[0],
+		P50: percentile(50),
+		P90: percentile(90),
+		P95: percentile(95),
+		P99: percentile(99),
+		Max: latencies[len(latencies)-1],
+	}
+}
+
+func (s *_Server) GetMaxConcurrentRequests(method, key string) int {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	limit, ok := s.concurrencyLimits[_Route{Method: method, Key: key}]
+	if !ok {
+		return 0
+	}
+	return int(atomic.LoadInt64(&limit.maxInFlight))
+}
+
+func (s *_Server) GetMetrics() ServerMetrics {
+	metrics := ServerMetrics{
+		TotalRequests:    s.GetRequestCount(),
+		RequestsByMethod: map[string]int{},
+		BytesReceived:    atomic.LoadInt64(&s.metrics.bytesReceived),
+		BytesSent:        atomic.LoadInt64(&s.metrics.bytesSent),
+	}
+
+	s.requestCountsByMethod.Range(func(method, count interface{}) bool {
+		metrics.RequestsByMethod[method.(string)] = int(atomic.LoadInt64(count.(*int64)))
+		return true
+	})
+
+	if responses := atomic.LoadInt64(&s.metrics.responses); responses > 0 {
+		metrics.AverageResponseTime = time.Duration(atomic.LoadInt64(&s.metrics.totalResponseTime) / responses)
+	}
+	return metrics
+}
+
+func (s *_Server) GetPATCHRequests(key string) []http.Request {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	return s.requests(http.MethodPatch, key)
+}
+
+func (s *_Server) GetPOSTBodyXML(key string, index int, v interface{}) error {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	entry, ok := s.requestEntry(http.MethodPost, key, index)
+	if !ok {
+		return fmt.Errorf("No httpPOSTRequest %v for '%v'", index, key)
+	}
+	return xml.Unmarshal(entry.Body, v)
+}
+
+func (s *_Server) GetPOSTFiles(key string, index int) []FormFile {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	entry, ok := s.requestEntry(http.MethodPost, key, index)
+	if !ok {
+		return nil
+	}
+
+	files, err := readFormFiles(entry.Header.Get("Content-Type"), entry.Body)
+	if err != nil {
+		return nil
+	}
+	return files
+}
+
+func (s *_Server) GetPOSTMultipartFiles(key string, index int) map[string][]byte {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	entry, ok := s.requestEntry(http.MethodPost, key, index)
+	if !ok {
+		return nil
+	}
+
+	files, err := readMultipartFiles(entry.Header.Get("Content-Type"), entry.Body)
+	if err != nil {
+		return nil
+	}
+	return files
+}
+
+func (s *_Server) GetPOSTRequest(key string, index int) (*http.Request, bool) {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	return s.request(http.MethodPost, key, index)
+}
+
+func (s *_Server) GetPOSTRequests(key string) []http.Request {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	return s.requests(http.MethodPost, key)
+}
+
+func (s *_Server) GetQuotaExceededCount(method, key string) int {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	quota, ok := s.quotas[_Route{Method: method, Key: key}]
+	if !ok {
+		return 0
+	}
+	return int(atomic.LoadInt64(&quota.exceeded))
+}
+
+func (s *_Server) GetRedirectHopCount(key string) int {
+	return s.redirectHops[key]
+}
+
+func (s *_Server) GetRequestBodyHash(method, key string, index int) string {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	entry, ok := s.requestEntry(method, key, index)
+	if !ok {
+		return ""
+	}
+	sum := sha256.Sum256(entry.Body)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *_Server) GetRequestByID(id string) (*http.Request, bool) {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	indexes := map[_Route]int{}
+	for _, entry := range s.requestLog {
+		route := _Route{Method: entry.Method, Key: entry.Key}
+		index := indexes[route]
+		indexes[route]++
+		if entry.Header.Get(requestIDHeader) == id {
+			return s.request(entry.Method, entry.Key, index)
+		}
+	}
+	return nil, false
+}
+
+func (s *_Server) GetRequestCount() int {
+	return int(atomic.LoadInt64(&s.requestCount))
+}
+
+func (s *_Server) GetRequestCountByMethod(method string) int {
+	count, ok := s.requestCountsByMethod.Load(method)
+	if !ok {
+		return 0
+	}
+	return int(atomic.LoadInt64(count.(*int64)))
+}
+
+func (s *_Server) GetRequestURL(method, key string, index int) *url.URL {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	r, ok := s.request(method, key, index)
+	if !ok {
+		return nil
+	}
+
+	u := &url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	if s.url != nil {
+		*u = *s.url
+	}
+
+	u.Path = r.URL.Path
+	u.RawPath = r.URL.RawPath
+	u.RawQuery = r.URL.RawQuery
+	return u
+}
+
+func (s *_Server) GetRequestsByUserAgent(method, key, ua string) []http.Request {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	requests := []http.Request{}
+	for _, r := range s.requestsFor(method)[key] {
+		if strings.HasPrefix(r.Header.Get("User-Agent"), ua) {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+func (s *_Server) GetRequestsInOrder(method string) []OrderedRequest {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	requests := s.requestsFor(method)
+	indexes := map[string]int{}
+
+	var ordered []OrderedRequest
+	for _, entry := range s.requestLog {
+		if entry.Method != method {
+			continue
+		}
+
+		index := indexes[entry.Key]
+		indexes[entry.Key]++
+		if index >= len(requests[entry.Key]) {
+			continue
+		}
+
+		ordered = append(ordered, OrderedRequest{
+			Request:    requests[entry.Key][index],
+			Key:        entry.Key,
+			Index:      index,
+			ReceivedAt: entry.ReceivedAt,
+		})
+	}
+	return ordered
+}
+
+func (s *_Server) GetResponseBodyFor(method, key string) (string, int, bool) {
+	response, ok := s.responsesFor(method)[key]
+	if !ok {
+		return "", 0, false
+	}
+
+	statusCode := response.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	return response.Body, statusCode, true
+}
+
+func (s *_Server) GetResponseLatency(method, key string, index int) time.Duration {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	rw, ok := s.recordedResponse(method, key, index)
+	if !ok {
+		return 0
+	}
+	latency, _ := rw.latency()
+	return latency
+}
+
+func (s *_Server) GetServerAddress() (string, int, error) {
+	if s.server == nil || s.url == nil {
+		return "", 0, fmt.Errorf("Server is not open")
+	}
+
+	host, portString, err := net.SplitHostPort(s.url.Host)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid port '%v'", portString)
+	}
+	return host, port, nil
+}
+
+func (s *_Server) GetTRACERequests(key string) []http.Request {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	return s.requests(http.MethodTrace, key)
+}
+
+func (s *_Server) IsOpen() bool {
+	return s.server != nil
+}
+
+func (s *_Server) LoadRequests(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var requestLog []RequestLogEntry
+	if err := json.Unmarshal(data, &requestLog); err != nil {
+		return err
+	}
+
+	s.requestsMutex.Lock()
+	s.requestLog = requestLog
+	s.requestsMutex.Unlock()
+	return nil
+}
+
+func (s *_Server) MaxConcurrency() int {
+	return int(atomic.LoadInt64(&s.maxInFlight))
+}
+
+func (s *_Server) MustClose() {
+	if err := s.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func (s *_Server) MustOpen() {
+	if err := s.Open(); err != nil {
+		panic(err)
+	}
+}
+
+func (s *_Server) Open() error {
+	if s.tlsCertificate != nil {
+		return s.OpenTLS()
+	}
+
+	s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.handleRequest))
+	s.server.Config.ReadTimeout = s.readTimeout
+	s.server.Start()
+	return s.parseURL()
+}
+
+func (s *_Server) OpenTLS() error {
+	s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.handleRequest))
+	s.server.Config.ReadTimeout = s.readTimeout
+	if s.tlsCertificate != nil {
+		s.server.TLS = &tls.Config{Certificates: []tls.Certificate{*s.tlsCertificate}}
+	}
+	s.server.StartTLS()
+	return s.parseURL()
+}
+
+func (s *_Server) PersistRequests(path string) error {
+	data, err := json.MarshalIndent(s.RequestLog(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (s *_Server) RecordedResponseFor(method, key string, index int) *httptest.ResponseRecorder {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	rw, ok := s.recordedResponse(method, key, index)
+	if !ok {
+		return nil
+	}
+	return rw.recorded()
+}
+
+func (s *_Server) RegisterMatcher(method string, m Matcher) {
+	if s.matchers == nil {
+		s.matchers = map[string][]Matcher{}
+	}
+	s.matchers[method] = append(s.matchers[method], m)
+}
+
+func (s *_Server) RemoveHeaderForwardingRule(srcHeader string) {
+	delete(s.headerForwardingRules, http.CanonicalHeaderKey(srcHeader))
+}
+
+func (s *_Server) RemoveRequiredHeader(header string) {
+	delete(s.requiredHeaders, http.CanonicalHeaderKey(header))
+}
+
+func (s *_Server) RequestLog() []RequestLogEntry {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	return append([]RequestLogEntry{}, s.requestLog...)
+}
+
+func (s *_Server) RequestsSince(t time.Time) []RequestLogEntry {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	entries := []RequestLogEntry{}
+	for _, entry := range s.requestLog {
+		if !entry.ReceivedAt.Before(t) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (s *_Server) RequireHeader(header, value string) {
+	if s.requiredHeaders == nil {
+		s.requiredHeaders = map[string]string{}
+	}
+	s.requiredHeaders[http.CanonicalHeaderKey(header)] = value
+}
+
+func (s *_Server) Reset() {
+	s.resetMutex.Lock()
+	defer s.resetMutex.Unlock()
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
+
+	s.httpGETResponses = map[string]Response{}
+	s.httpPATCHResponses = map[string]Response{}
+	s.httpPOSTResponses = map[string]Response{}
+
+	s.httpGETRequests = map[string][]http.Request{}
+	s.httpPATCHRequests = map[string][]http.Request{}
+	s.httpPOSTRequests = map[string][]http.Request{}
+	s.httpTRACERequests = map[string][]http.Request{}
+
+	atomic.StoreInt64(&s.maxInFlight, 0)
+	s.metrics = &_Metrics{}
+	atomic.StoreInt64(&s.requestCount, 0)
+	s.requestCountsByMethod = &sync.Map{}
+	s.requestLog = nil
+	s.routeStats = newRouteStats()
+	s.assertionMutex.Lock()
+	s.assertionPanics = nil
+	s.assertionMutex.Unlock()
+
+	s.abortAfterBytes = map[string]int{}
+	s.abortedRequests = map[_Route]int{}
+	s.afterResponses = map[_Route]_AfterResponse{}
+	s.alwaysResponse = nil
+	s.assertions = map[string][]func(*http.Request){}
+	s.autoCompress = map[string]bool{}
+	s.bodyMatchers = map[_Route][]func([]byte) bool{}
+	s.bodyTransformers = map[string]func(body string, r *http.Request) string{}
+	s.concurrencyLimits = map[_Route]*_ConcurrencyLimit{}
+	s.conditionalResponses = map[string][]_ConditionalResponse{}
+	s.contentTypeResponses = map[string]map[string]Response{}
+	s.contentTypes = map[_Route]string{}
+	s.countResponses = map[_Route]map[int]Response{}
+	s.delayedResponses = map[string]_DelayedResponse{}
+	s.dependencies = map[string][]string{}
+	s.echoHandlers = map[_Route]bool{}
+	s.expectations = map[_Route]*_Expectation{}
+	s.generatedResponses = map[string][]string{}
+	s.generators = map[string]func() string{}
+	s.idempotencyKeyReuses = map[_Route]int{}
+	s.idempotencyResponses = map[string]*httptest.ResponseRecorder{}
+	s.jsonpResponses = map[string]_JSONPResponse{}
+	s.onceResponses = map[string]Response{}
+	s.pagedResponses = map[string]_PagedResponse{}
+	s.quotas = map[_Route]*_Quota{}
+	s.recordedResponses = map[_Route][]*_ResponseWriter{}
+	s.redirectHops = map[string]int{}
+	s.remoteAddrResponses = map[string]map[string]Response{}
+	s.requestSizeLimits = map[_Route]int64{}
+	s.requestTimeouts = map[string]time.Duration{}
+	s.responseCallbacks = map[_Route]func(req *http.Request, resp *Response){}
+	s.roundRobins = map[_Route]*_RoundRobin{}
+	s.slowStarts = map[_Route]*_SlowStart{}
+	s.streams = map[string]_Stream{}
+	s.userAgentResponses = map[string]map[string]Response{}
+
+	if s.grpcTranscodingMatcher != nil {
+		s.grpcTranscodingMatcher.paths = map[string]bool{}
+	}
+	if s.openAPIMatcher != nil {
+		s.openAPIMatcher.templates = nil
+	}
+}
+
+func (s *_Server) Serve(l net.Listener) error {
+	s.server = httptest.NewUnstartedServer(http.HandlerFunc(s.handleRequest))
+	s.server.Listener.Close()
+	s.server.Listener = l
+	s.server.Config.ReadTimeout = s.readTimeout
+	if s.tlsCertificate != nil {
+		s.server.TLS = &tls.Config{Certificates: []tls.Certificate{*s.tlsCertificate}}
+		s.server.StartTLS()
+	} else {
+		s.server.Start()
+	}
+	return s.parseURL()
+}
+
+func (s *_Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handleRequest(w, r)
+}
+
+func (s *_Server) SetAlwaysResponse(statusCode int, contentType, body string) {
+	s.alwaysResponse = &Response{
+		StatusCode:  statusCode,
+		ContentType: contentType,
+		Headers:     make(http.Header),
+		Body:        body,
+	}
+}
+
+func (s *_Server) SetConcurrencyLimit(method, key string, maxConcurrent int) {
+	s.concurrencyLimits[_Route{Method: method, Key: key}] = &_ConcurrencyLimit{
+		semaphore: make(chan struct{}, maxConcurrent),
+	}
+}
+
+func (s *_Server) SetContentTypeForKey(method, key, contentType string) {
+	s.contentTypes[_Route{Method: method, Key: key}] = contentType
+}
+
+func (s *_Server) SetDefaultResponseHeaders(headers http.Header) {
+	s.defaultResponseHeaders = headers.Clone()
+}
+
+func (s *_Server) SetEchoHandler(method, path string) {
+	s.echoHandlers[_Route{Method: method, Key: path}] = true
+}
+
+func (s *_Server) SetExpectAtLeast(method, key string, n int) {
+	s.expectation(method, key).atLeast = n
+}
+
+func (s *_Server) SetExpectAtMost(method, key string, n int) {
+	s.expectation(method, key).atMost = n
+}
+
+func (s *_Server) SetExpectExactly(method, key string, n int) {
+	expectation := s.expectation(method, key)
+	expectation.atLeast = n
+	expectation.atMost = n
+}
+
+func (s *_Server) SetGETJSONPResponse(key, callbackParam, responseBody string) {
+	s.jsonpResponses[key] = _JSONPResponse{
+		callbackParam: callbackParam,
+		body:          responseBody,
+	}
+}
+
+func (s *_Server) SetGETPagedResponse(key string, pages []string, pageQueryParam string) {
+	s.pagedResponses[key] = _PagedResponse{
+		pageQueryParam: pageQueryParam,
+		pages:          append([]string{}, pages...),
+	}
+}
+
+func (s *_Server) SetGETRedirectSequence(key string, hops []string, finalStatusCode int, finalBody string) {
+	current := key
+	for _, hop := range hops {
+		headers := make(http.Header)
+		headers.Set("Location", hop)
+		s.httpGETResponses[current] = Response{
+			StatusCode: http.StatusFound,
+			Headers:    headers,
+		}
+
+		current = hop
+		if !strings.Contains(current, "?") {
+			current += "?"
+		}
+	}
+
+	s.httpGETResponses[current] = Response{
+		StatusCode: finalStatusCode,
+		Headers:    make(http.Header),
+		Body:       finalBody,
+	}
+	s.redirectHops[key] = len(hops)
+}
+
+func (s *_Server) SetGETRequestTimeout(key string, d time.Duration) {
+	s.requestTimeouts[key] = d
+}
+
+func (s *_Server) SetGETResponseAfterDelay(key string, delay time.Duration, r Response) {
+	s.delayedResponses[key] = _DelayedResponse{
+		delay:    delay,
+		response: withHeaders(r),
+	}
+}
+
+func (s *_Server) SetGETResponseAutoCompress(key string, enabled bool) {
+	if enabled {
+		s.autoCompress[key] = true
+	} else {
+		delete(s.autoCompress, key)
+	}
+}
+
+func (s *_Server) SetGETResponseBody(key, responseBody string, statusCode ...int) {
+	status := http.StatusOK
+	if len(statusCode) > 0 {
+		status = statusCode[0]
+	}
+
+	s.httpGETResponses[key] = Response{
+		StatusCode: status,
+		Headers:    make(http.Header),
+		Body:       responseBody,
+	}
+}
+
+func (s *_Server) SetGETResponseBodyAndAssert(key, body string, assertions ...func(*http.Request)) {
+	s.SetGETResponseBody(key, body)
+	s.assertions[key] = append([]func(*http.Request){}, assertions...)
+}
+
+func (s *_Server) SetGETResponseBodyBase64(key string, statusCode int, contentType, base64Body string) error {
+	body, err := base64.StdEncoding.DecodeString(base64Body)
+	if err != nil {
+		return err
+	}
+	s.SetGETResponseBodyBytes(key, statusCode, contentType, body)
+	return nil
+}
+
+func (s *_Server) SetGETResponseBodyBytes(key string, statusCode int, contentType string, body []byte) {
+	s.httpGETResponses[key] = Response{
+		StatusCode:  statusCode,
+		ContentType: contentType,
+		Headers:     make(http.Header),
+		Body:        string(body),
+	}
+}
+
+func (s *_Server) SetGETResponseBodyFromTemplate(key, tmplStr string, data interface{}) error {
+	tmpl, err := template.New(key).Parse(tmplStr)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, data); err != nil {
+		return err
+	}
+
+	s.SetGETResponseBody(key, body.String())
+	return nil
+}
+
+func (s *_Server) SetGETResponseBodyGenerator(key string, gen func() string) {
+	s.generators[key] = gen
+}
+
+func (s *_Server) SetGETResponseBodyHex(key string, statusCode int, contentType, hexBody string) error {
+	body, err := hex.DecodeString(hexBody)
+	if err != nil {
+		return err
+	}
+	s.SetGETResponseBodyBytes(key, statusCode, contentType, body)
+	return nil
+}
+
+func (s *_Server) SetGETResponseBodyJSON(key string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.SetGETResponseBody(key, string(body))
+	return nil
+}
+
+func (s *_Server) SetGETResponseBodyTransformer(key string, fn func(body string, r *http.Request) string) {
+	s.bodyTransformers[key] = fn
+}
+
+func (s *_Server) SetGETResponseCancelContext(key string, afterBytes int) {
+	s.abortAfterBytes[key] = afterBytes
+}
+
+func (s *_Server) SetGETResponseDependsOn(key string, requiredKey string) {
+	s.dependencies[key] = append(s.dependencies[key], requiredKey)
+}
+
+func (s *_Server) SetGETResponseForRemoteAddr(key, addr string, r Response) {
+	if s.remoteAddrResponses[key] == nil {
+		s.remoteAddrResponses[key] = map[string]Response{}
+	}
+	s.remoteAddrResponses[key][addr] = withHeaders(r)
+}
+
+func (s *_Server) SetGETResponseForUserAgent(key, userAgent string, r Response) {
+	if s.userAgentResponses[key] == nil {
+		s.userAgentResponses[key] = map[string]Response{}
+	}
+	s.userAgentResponses[key][userAgent] = withHeaders(r)
+}
+
+func (s *_Server) SetGETResponseFromHTTPResponse(key string, resp *http.Response) error {
+	response, err := readResponse(resp)
+	if err != nil {
+		return err
+	}
+	s.httpGETResponses[key] = response
+	return nil
+}
+
+func (s *_Server) SetGETResponseGzip(key, responseBody string) {
+	headers := make(http.Header)
+	headers.Set("Content-Encoding", "gzip")
+	s.httpGETResponses[key] = Response{
+		StatusCode:  http.StatusOK,
+		ContentType: "application/json",
+		Headers:     headers,
+		Body:        compress("gzip", responseBody),
+	}
+}
+
+func (s *_Server) SetGETResponseOnCondition(key string, cond func(*http.Request) bool, r Response) {
+	s.conditionalResponses[key] = append(s.conditionalResponses[key], _ConditionalResponse{
+		cond:     cond,
+		response: withHeaders(r),
+	})
+}
+
+func (s *_Server) SetGETResponseOnce(key string, r Response) {
+	s.onceMutex.Lock()
+	s.onceResponses[key] = withHeaders(r)
+	s.onceMutex.Unlock()
+}
+
+func (s *_Server) SetGETXMLResponse(key, responseBody string) {
+	s.httpGETResponses[key] = Response{
+		StatusCode:  http.StatusOK,
+		ContentType: "application/xml",
+		Headers:     make(http.Header),
+		Body:        responseBody,
+	}
+}
+
+func (s *_Server) SetHMACSigning(secret []byte, headerName string, algorithm string) error {
+	if secret == nil {
+		s.hmacSigning = nil
+		return nil
+	}
+
+	var h func() hash.Hash
+	switch strings.ToLower(algorithm) {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	case "sha512":
+		h = sha512.New
+	default:
+		return fmt.Errorf("Unsupported HMAC algorithm '%v'", algorithm)
+	}
+
+	s.hmacSigning = &_HMACSigning{
+		secret:     secret,
+		headerName: headerName,
+		hash:       h,
+	}
+	return nil
+}
+
+func (s *_Server) SetHeaderForwardingRule(srcHeader, dstHeader string) {
+	if s.headerForwardingRules == nil {
+		s.headerForwardingRules = map[string]string{}
+	}
+	s.headerForwardingRules[http.CanonicalHeaderKey(srcHeader)] = dstHeader
+}
+
+func (s *_Server) SetHealthCheck(path string) {
+	s.healthCheckPath = path
+}
+
+func (s *_Server) SetIdempotencyKeyHeader(headerName string) {
+	s.idempotencyKeyHeader = headerName
+}
+
+func (s *_Server) SetIdempotencyKeyReplay(replay bool) {
+	s.idempotencyKeyReplay = replay
+}
+
+func (s *_Server) SetMaxRequests(method, key string, n int) {
+	s.quotas[_Route{Method: method, Key: key}] = &_Quota{maxRequests: int64(n)}
+}
+
+func (s *_Server) SetPATCHMergePatchResponse(path string, expectedPatch interface{}, statusCode int, responseBody string) error {
+	patch, err := json.Marshal(expectedPatch)
+	if err != nil {
+		return err
+	}
+
+	key := path
+	if !strings.Contains(key, "?") {
+		key += "?"
+	}
+	key += " " + string(normalizeJSON(patch))
+
+	s.httpPATCHResponses[key] = Response{
+		StatusCode: statusCode,
+		Headers:    make(http.Header),
+		Body:       responseBody,
+	}
+	return nil
+}
+
+func (s *_Server) SetPOSTFormFieldName(fieldName string) {
+	s.postFormFieldName = fieldName
+}
+
+func (s *_Server) SetPOSTResponseBody(key, responseBody string) {
+	s.httpPOSTResponses[key] = Response{
+		StatusCode: http.StatusOK,
+		Headers:    make(http.Header),
+		Body:       responseBody,
+	}
+}
+
+func (s *_Server) SetPOSTResponseBodyForContentType(key, contentType string, statusCode int, body string) {
+	s.SetPOSTResponseByContentType(key, contentType, Response{
+		StatusCode: statusCode,
+		Body:       body,
+	})
+}
+
+func (s *_Server) SetPOSTResponseBodyJSON(key string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.SetPOSTResponseBody(key, string(body))
+	return nil
+}
+
+func (s *_Server) SetPOSTResponseByContentType(key string, contentType string, r Response) {
+	if s.contentTypeResponses[key] == nil {
+		s.contentTypeResponses[key] = map[string]Response{}
+	}
+	s.contentTypeResponses[key][mediaType(contentType)] = withHeaders(r)
+}
+
+func (s *_Server) SetRemoteAddrOverride(addr string) {
+	s.remoteAddrOverride = addr
+}
+
+func (s *_Server) SetRequestBodyMatcher(method, key string, matcher func([]byte) bool) {
+	route := _Route{Method: method, Key: key}
+	s.bodyMatchers[route] = append(s.bodyMatchers[route], matcher)
+}
+
+func (s *_Server) SetRequestSizeLimit(maxBytes int64) {
+	s.requestSizeLimit = maxBytes
+}
+
+func (s *_Server) SetRequestSizeLimitForKey(method, key string, maxBytes int64) {
+	s.requestSizeLimits[_Route{Method: method, Key: key}] = maxBytes
+}
+
+func (s *_Server) SetRequestTransformer(fn func(r *http.Request) *http.Request) {
+	s.requestTransformer = fn
+}
+
+func (s *_Server) SetResponseAfterRequests(method, key string, after int, r Response) {
+	s.afterResponses[_Route{Method: method, Key: key}] = _AfterResponse{
+		after:    after,
+		response: withHeaders(r),
+	}
+}
+
+func (s *_Server) SetResponseBodyFromEnv(method, key string, envVar string) error {
+	body := os.Getenv(envVar)
+	if body == "" {
+		return fmt.Errorf("Environment variable '%v' is empty", envVar)
+	}
+
+	responses := s.responsesFor(method)
+	if responses == nil {
+		return fmt.Errorf("Unsupported method '%v' for '%v'", method, key)
+	}
+	responses[key] = Response{
+		StatusCode: http.StatusOK,
+		Headers:    make(http.Header),
+		Body:       body,
+	}
+	return nil
+}
+
+func (s *_Server) SetResponseCallback(method, key string, fn func(req *http.Request, resp *Response)) {
+	s.responseCallbacks[_Route{Method: method, Key: key}] = fn
+}
+
+func (s *_Server) SetResponseForRequestCount(method, key string, count int, r Response) {
+	route := _Route{Method: method, Key: key}
+	if s.countResponses[route] == nil {
+		s.countResponses[route] = map[int]Response{}
+	}
+	s.countResponses[route][count] = withHeaders(r)
+}
+
+func (s *_Server) SetResponseInterceptor(fn func(w http.ResponseWriter, r *http.Request, next func())) {
+	s.interceptors = append(s.interceptors, fn)
+}
+
+func (s *_Server) SetResponseRoundRobin(method, key string, responses []Response) {
+	if len(responses) == 0 {
+		delete(s.roundRobins, _Route{Method: method, Key: key})
+		return
+	}
+	roundRobin := &_RoundRobin{
+		responses: append([]Response{}, responses...),
+	}
+	for i := range roundRobin.responses {
+		roundRobin.responses[i] = withHeaders(roundRobin.responses[i])
+	}
+	s.roundRobins[_Route{Method: method, Key: key}] = roundRobin
+}
+
+func (s *_Server) SetResponseStreamFrom(key string, r io.Reader, contentType string) {
+	s.streams[key] = _Stream{
+		reader:      r,
+		contentType: contentType,
+	}
+}
+
+func (s *_Server) SetSlowStart(method, key string, delay time.Duration) {
+	s.slowStarts[_Route{Method: method, Key: key}] = &_SlowStart{delay: delay}
+}
+
+func (s *_Server) SetTRACEEnabled(enabled bool) {
+	s.traceEnabled = enabled
+}
+
+func (s *_Server) TLSCert() ([]byte, error) {
+	if s.server == nil || s.server.TLS == nil {
+		return nil, fmt.Errorf("Server is not serving TLS")
+	}
+
+	certificate := s.server.Certificate()
+	if certificate == nil {
+		return nil, fmt.Errorf("Server has no TLS certificate")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}), nil
+}
+
+func (s *_Server) UnsetAlwaysResponse() {
+	s.alwaysResponse = nil
+}
+
+func (s *_Server) UnsetHealthCheck() {
+	s.healthCheckPath = ""
+}
+
+func (s *_Server) URL() *url.URL {
+	return s.url
+}
+
+// privates
+func (l *_ConcurrencyLimit) acquire() bool {
+	select {
+	case l.semaphore <- struct{}{}:
+	default:
+		return false
+	}
+
+	storeMax(&l.maxInFlight, atomic.AddInt64(&l.inFlight, 1))
+	return true
+}
+
+func (l *_ConcurrencyLimit) release() {
+	atomic.AddInt64(&l.inFlight, -1)
+	<-l.semaphore
+}
+
+func (h *_HMACSigning) verify(r *http.Request, body []byte) bool {
+	signature, err := hex.DecodeString(r.Header.Get(h.headerName))
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+
+	mac := hmac.New(h.hash, h.secret)
+	mac.Write(body)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+func (m *_Metrics) recordResponse(bodySize int, elapsed time.Duration) {
+	atomic.AddInt64(&m.bytesSent, int64(bodySize))
+	atomic.AddInt64(&m.responses, 1)
+	atomic.AddInt64(&m.totalResponseTime, int64(elapsed))
+}
+
+func (w *_ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("ResponseWriter doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (w *_ResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *_ResponseWriter) WriteHeader(statusCode int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+		for name, values := range w.Header() {
+			w.recorder.Header()[name] = append([]string{}, values...)
+		}
+		w.recorder.WriteHeader(statusCode)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+	w.completedAt = time.Now()
+}
+
+func (w *_ResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.bodySize += n
+	w.recorder.Write(b[:n])
+	w.completedAt = time.Now()
+	return n, err
+}
+
+// latency returns the time between the request reaching the
+// server and the last write of its response, and false if
+// nothing has been written yet
+func (w *_ResponseWriter) latency() (time.Duration, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.completedAt.IsZero() {
+		return 0, false
+	}
+	return w.completedAt.Sub(w.startedAt), true
+}
+
+// recorded returns a copy of the response written so far
+func (w *_ResponseWriter) recorded() *httptest.ResponseRecorder {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	recorder := httptest.NewRecorder()
+	for name, values := range w.recorder.Header() {
+		recorder.Header()[name] = append([]string{}, values...)
+	}
+	if w.statusCode != 0 {
+		recorder.WriteHeader(w.recorder.Code)
+	}
+	recorder.Write(w.recorder.Body.Bytes())
+	return recorder
+}
+
+func (s *_Server) clearRequests(method, key string) {
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
+
+	delete(s.requestsFor(method), key)
+	delete(s.recordedResponses, _Route{Method: method, Key: key})
+
+	var requestLog []RequestLogEntry
+	for _, entry := range s.requestLog {
+		if entry.Method != method || entry.Key != key {
+			requestLog = append(requestLog, entry)
+		}
+	}
+	s.requestLog = requestLog
+}
+
+func (s *_Server) expectation(method, key string) *_Expectation {
+	route := _Route{Method: method, Key: key}
+	if _, ok := s.expectations[route]; !ok {
+		s.expectations[route] = &_Expectation{atMost: -1}
+	}
+	return s.expectations[route]
+}
+
+func (s *_Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	// hold off Reset until the response is chosen so the
+	// handler never sees a mix of old and new maps
+	r = s.holdOffReset(r)
+	defer releaseReset(r)
+
+	atomic.AddInt64(&s.requestCount, 1)
+	count, _ := s.requestCountsByMethod.LoadOrStore(r.Method, new(int64))
+	atomic.AddInt64(count.(*int64), 1)
+
+	storeMax(&s.maxInFlight, atomic.AddInt64(&s.inFlight, 1))
+	defer atomic.AddInt64(&s.inFlight, -1)
+	metrics, routeStats := s.metrics, s.routeStats
+
+	startedAt := time.Now()
+	rw := &_ResponseWriter{
+		ResponseWriter: w,
+		recorder:       httptest.NewRecorder(),
+		startedAt:      startedAt,
+	}
+	defer func() {
+		elapsed := time.Since(startedAt)
+		metrics.recordResponse(rw.bodySize, elapsed)
+		if rw.route != nil {
+			routeStats.record(*rw.route, rw.statusCode, elapsed)
+		}
+		if s.logger != nil {
+			s.logger.Printf("%v %v?%v -> %v %v %v",
+				r.Method, r.URL.Path, r.URL.RawQuery, rw.statusCode, rw.bodySize, elapsed)
+		}
+	}()
+	w = rw
+
+	next := func() { s.routeRequest(w, r) }
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := s.interceptors[i], next
+		next = func() { interceptor(w, r, inner) }
+	}
+	next()
+}
+
+func (s *_Server) routeRequest(w http.ResponseWriter, r *http.Request) {
+	for name, values := range s.defaultResponseHeaders {
+		w.Header()[name] = append([]string{}, values...)
+	}
+
+	if s.healthCheckPath != "" && r.URL.Path == s.healthCheckPath {
+		s.writeResponse(w, Response{Body: `{"status":"ok"}`})
+		return
+	}
+
+	if s.prometheusMetricsPath != "" && r.URL.Path == s.prometheusMetricsPath {
+		s.writePrometheusMetrics(w)
+		return
+	}
+
+	if s.generateRequestIDs {
+		if r.Header.Get(requestIDHeader) == "" {
+			r.Header.Set(requestIDHeader, newUUID())
+		}
+		w.Header().Set(requestIDHeader, r.Header.Get(requestIDHeader))
+	}
+
+	if s.remoteAddrOverride != "" {
+		r.RemoteAddr = s.remoteAddrOverride
+	}
+
+	bodyReader := io.Reader(r.Body)
+	if s.requestSizeLimit > 0 {
+		bodyReader = io.LimitReader(r.Body, s.requestSizeLimit+1)
+	}
+	body, err := ioutil.ReadAll(bodyReader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.requestSizeLimit > 0 && int64(len(body)) > s.requestSizeLimit {
+		http.Error(w, fmt.Sprintf("Request body exceeds %v bytes", s.requestSizeLimit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	atomic.AddInt64(&s.metrics.bytesReceived, int64(len(body)))
+
+	for header, value := range s.requiredHeaders {
+		if r.Header.Get(header) != value {
+			http.Error(w, fmt.Sprintf("Missing or invalid required header '%v'", header), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s.hmacSigning != nil && !s.hmacSigning.verify(r, body) {
+		http.Error(w, fmt.Sprintf("Invalid signature in '%v'", s.hmacSigning.headerName), http.StatusForbidden)
+		return
+	}
+
+	keyed, keyedBody := r, body
+	if s.requestTransformer != nil {
+		keyed, keyedBody, err = s.transformRequest(r, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if s.echoHandlers[_Route{Method: r.Method, Key: keyed.URL.Path}] {
+		key, _ := DefaultMatcher{}.Match(keyed)
+		s.respond(w, r, r.Method, key, body)
+		return
+	}
+
+	if m, key, ok := s.matchRequest(keyed, keyedBody); ok {
+		if paramsMatcher, ok := m.(PathParamsMatcher); ok {
+			r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, paramsMatcher.PathParams(keyed)))
+		}
+		s.respond(w, r, r.Method, key, body)
+		return
+	}
+
+	if key, ok := s.matchRequestBody(keyed, keyedBody); ok {
+		s.respond(w, r, r.Method, key, body)
+		return
+	}
+
+	if recording := s.recording; recording != nil && s.responsesFor(r.Method) == nil {
+		// requests of other methods have no key of their own, so
+		// they're keyed by path and query and their raw body
+		pathAndQuery, _ := DefaultMatcher{}.Match(keyed)
+		s.proxy(w, r, recording, r.Method, pathAndQuery+" "+string(keyedBody), body)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		// content type responses are keyed without the body, so
+		// they also match requests that aren't multipart
+		pathAndQuery, _ := DefaultMatcher{}.Match(keyed)
+		if _, ok := s.contentTypeResponses[pathAndQuery][mediaType(r.Header.Get("Content-Type"))]; ok {
+			s.respond(w, r, http.MethodPost, pathAndQuery, body)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleGetRequest(w, r, body, keyed, keyedBody)
+		return
+	case http.MethodPatch:
+		s.handlePatchRequest(w, r, body, keyed, keyedBody)
+		return
+	case http.MethodPost:
+		s.handlePostRequest(w, r, body, keyed, keyedBody)
+		return
+	case http.MethodTrace:
+		if s.traceEnabled {
+			s.handleTraceRequest(w, r, body)
+			return
+		}
+	}
+
+	// requests of other methods have no key to look up
+	if s.alwaysResponse != nil {
+		s.writeResponse(w, *s.alwaysResponse)
+	}
+}
+
+// The handlers below compute the key from keyed and keyedBody,
+// which differ from r and body only when a request transformer
+// is set, and record the original request under that key
+func (s *_Server) handleGetRequest(w http.ResponseWriter, r *http.Request, body []byte, keyed *http.Request, keyedBody []byte) {
+	if s.getKeyFunc != nil {
+		s.respond(w, r, http.MethodGet, s.getKeyFunc(keyed, keyedBody), body)
+		return
+	}
+
+	key, _ := DefaultMatcher{}.Match(keyed)
+	s.respond(w, r, http.MethodGet, key, body)
+}
+
+func (s *_Server) handlePatchRequest(w http.ResponseWriter, r *http.Request, body []byte, keyed *http.Request, keyedBody []byte) {
+	pathAndQuery, _ := DefaultMatcher{}.Match(keyed)
+	key := pathAndQuery + " " + string(normalizeJSON(keyedBody))
+	s.respond(w, r, http.MethodPatch, key, body)
+}
+
+func (s *_Server) handlePostRequest(w http.ResponseWriter, r *http.Request, body []byte, keyed *http.Request, keyedBody []byte) {
+	if s.postKeyFunc != nil {
+		s.respond(w, r, http.MethodPost, s.postKeyFunc(keyed, keyedBody), body)
+		return
+	}
+
+	pathAndQuery, _ := DefaultMatcher{}.Match(keyed)
+	if files, err := readMultipartFiles(keyed.Header.Get("Content-Type"), keyedBody); err == nil && len(files) > 1 {
+		s.respond(w, r, http.MethodPost, POSTMultipartKey(pathAndQuery, files), body)
+		return
+	}
+
+	fieldName := s.postFormFieldName
+	if fieldName == "" {
+		fieldName = "file"
+	}
+
+	f, _, err := keyed.FormFile(fieldName)
+	if err != nil && s.recording != nil {
+		s.respond(w, r, http.MethodPost, pathAndQuery+" "+string(keyedBody), body)
+		return
+	}
+	if err != nil && s.alwaysResponse != nil {
+		s.writeResponse(w, *s.alwaysResponse)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+
+	fileBody, err := ioutil.ReadAll(f)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	key := pathAndQuery + " " + string(fileBody)
+	s.respond(w, r, http.MethodPost, key, body)
+}
+
+func (s *_Server) handleTraceRequest(w http.ResponseWriter, r *http.Request, body []byte) {
+	key, _ := DefaultMatcher{}.Match(r)
+	s.requestsMutex.Lock()
+	s.recordRequest(http.MethodTrace, key, r, body)
+	s.requestsMutex.Unlock()
+
+	dump, err := httputil.DumpRequest(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/http")
+	w.WriteHeader(http.StatusOK)
+	w.Write(dump)
+}
+
+// holdOffReset makes Reset wait until releaseReset
+// is called with the returned request
+func (s *_Server) holdOffReset(r *http.Request) *http.Request {
+	s.resetMutex.RLock()
+	var once sync.Once
+	release := func() { once.Do(s.resetMutex.RUnlock) }
+	return r.WithContext(context.WithValue(r.Context(), releaseResetKey{}, release))
+}
+
+func (s *_Server) lookupResponse(r *http.Request, method, key string) (Response, bool) {
+	if method == http.MethodGet {
+		if response, ok := s.takeOnceResponse(key); ok {
+			return response, true
+		}
+
+		if delayed, ok := s.delayedResponses[key]; ok && time.Since(s.openedAt) >= delayed.delay {
+			return delayed.response, true
+		}
+
+		for _, conditional := range s.conditionalResponses[key] {
+			if conditional.cond(r) {
+				return conditional.response, true
+			}
+		}
+	}
+
+	if response, ok := s.countResponses[_Route{Method: method, Key: key}][s.requestsMade(method, key)]; ok {
+		return response, true
+	}
+
+	if after, ok := s.afterResponses[_Route{Method: method, Key: key}]; ok && s.requestsMade(method, key) > after.after {
+		return after.response, true
+	}
+
+	if roundRobin, ok := s.roundRobins[_Route{Method: method, Key: key}]; ok {
+		index := atomic.AddUint64(&roundRobin.index, 1) - 1
+		return roundRobin.responses[index%uint64(len(roundRobin.responses))], true
+	}
+
+	if gen, ok := s.generators[key]; ok && method == http.MethodGet {
+		body := gen()
+		s.requestsMutex.Lock()
+		s.generatedResponses[key] = append(s.generatedResponses[key], body)
+		s.requestsMutex.Unlock()
+		return Response{
+			StatusCode: http.StatusOK,
+			Headers:    make(http.Header),
+			Body:       body,
+		}, true
+	}
+
+	if method == http.MethodPost {
+		if response, ok := s.contentTypeResponses[key][mediaType(r.Header.Get("Content-Type"))]; ok {
+			return response, true
+		}
+	}
+
+	if method == http.MethodGet {
+		if response, ok := s.lookupJSONPResponse(r); ok {
+			return response, true
+		}
+		if response, ok := s.lookupPagedResponse(r); ok {
+			return response, true
+		}
+		if response, ok := s.lookupRemoteAddrResponse(r, key); ok {
+			return response, true
+		}
+	}
+
+	if response, ok := s.responsesFor(method)[key]; ok {
+		return response, true
+	}
+
+	if method == http.MethodGet {
+		return s.lookupUserAgentResponse(r, key)
+	}
+	return Response{}, false
+}
+
+func (s *_Server) lookupJSONPResponse(r *http.Request) (Response, bool) {
+	for key, jsonp := range s.jsonpResponses {
+		rawQuery, callback := removeQueryParam(r.URL.RawQuery, jsonp.callbackParam)
+		if r.URL.Path+"?"+rawQuery != key {
+			continue
+		}
+
+		if callback == "" {
+			return Response{
+				StatusCode: http.StatusOK,
+				Headers:    make(http.Header),
+				Body:       jsonp.body,
+			}, true
+		}
+		return Response{
+			StatusCode:  http.StatusOK,
+			ContentType: "application/javascript",
+			Headers:     make(http.Header),
+			Body:        callback + "(" + jsonp.body + ")",
+		}, true
+	}
+	return Response{}, false
+}
+
+func (s *_Server) lookupPagedResponse(r *http.Request) (Response, bool) {
+	for key, paged := range s.pagedResponses {
+		rawQuery, page := removeQueryParam(r.URL.RawQuery, paged.pageQueryParam)
+		if r.URL.Path+"?"+rawQuery != key {
+			continue
+		}
+
+		index := 0
+		if page != "" {
+			n, err := strconv.Atoi(page)
+			if err != nil || n < 1 {
+				return Response{}, false
+			}
+			index = n - 1
+		}
+
+		body := "[]"
+		if index < len(paged.pages) {
+			body = paged.pages[index]
+		}
+		return Response{
+			StatusCode: http.StatusOK,
+			Headers:    make(http.Header),
+			Body:       body,
+		}, true
+	}
+	return Response{}, false
+}
+
+func (s *_Server) lookupRemoteAddrResponse(r *http.Request, key string) (Response, bool) {
+	responses := s.remoteAddrResponses[key]
+	if response, ok := responses[r.RemoteAddr]; ok {
+		return response, true
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if response, ok := responses[host]; ok {
+			return response, true
+		}
+	}
+	return Response{}, false
+}
+
+func (s *_Server) lookupUserAgentResponse(r *http.Request, key string) (Response, bool) {
+	userAgent := r.Header.Get("User-Agent")
+	var response Response
+	longest := -1
+	for prefix, candidate := range s.userAgentResponses[key] {
+		if strings.HasPrefix(userAgent, prefix) && len(prefix) > longest {
+			response, longest = candidate, len(prefix)
+		}
+	}
+	return response, longest >= 0
+}
+
+func (s *_Server) parseURL() error {
+	var err error
+	s.openedAt = time.Now()
+	s.url, err = url.Parse(s.server.URL)
+	return err
+}
+
+// matchRequest asks the matchers registered for the method
+// of r, in order, for the key of r. It also returns the
+// matcher that matched
+func (s *_Server) matchRequest(r *http.Request, body []byte) (Matcher, string, bool) {
+	for _, m := range s.matchers[r.Method] {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		key, ok := m.Match(r)
+		if ok {
+			return m, key, true
+		}
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil, "", false
+}
+
+// matchRequestBody returns the key of the first route, in
+// sorted order, for the method and path and query of r that
+// has a body matcher returning true for body
+func (s *_Server) matchRequestBody(r *http.Request, body []byte) (string, bool) {
+	pathAndQuery, _ := DefaultMatcher{}.Match(r)
+
+	var routes []_Route
+	for route, matchers := range s.bodyMatchers {
+		if route.Method != r.Method || strings.SplitN(route.Key, " ", 2)[0] != pathAndQuery {
+			continue
+		}
+		for _, matcher := range matchers {
+			if matcher(body) {
+				routes = append(routes, route)
+				break
+			}
+		}
+	}
+	if len(routes) == 0 {
+		return "", false
+	}
+
+	sortRoutes(routes)
+	return routes[0].Key, true
+}
+
+// normalizeJSON re-encodes body so that equivalent JSON
+// documents produce identical bytes. Bodies that are not
+// valid JSON are returned unchanged
+func normalizeJSON(body []byte) []byte {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+
+	normalized, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return normalized
+}
+
+// readMultipartFiles returns the files in a multipart body,
+// mapped from form field name to content. Only the first
+// file is kept when a field holds several
+func readMultipartFiles(contentType string, body []byte) (map[string][]byte, error) {
+	formFiles, err := readFormFiles(contentType, body)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	for _, file := range formFiles {
+		if _, ok := files[file.FieldName]; !ok {
+			files[file.FieldName] = file.Content
+		}
+	}
+	return files, nil
+}
+
+func readFormFiles(contentType string, body []byte) ([]FormFile, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("Content-Type '%v' is not multipart", mediaType)
+	}
+
+	var files []FormFile
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() == "" {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, FormFile{
+			FieldName:   part.FormName(),
+			Filename:    part.FileName(),
+			ContentType: part.Header.Get("Content-Type"),
+			Content:     content,
+		})
+	}
+}
+
+func (s *_Server) recordedResponse(method, key string, index int) (*_ResponseWriter, bool) {
+	responses := s.recordedResponses[_Route{Method: method, Key: key}]
+	if index < 0 || index >= len(responses) {
+		return nil, false
+	}
+	return responses[index], true
+}
+
+func (s *_Server) recordRequest(method, key string, r *http.Request, body []byte) {
+	// record a deep copy with its own body so the recorded
+	// request doesn't share state with the handler's request
+	recorded := r.Clone(r.Context())
+	recorded.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	requests := s.requestsFor(method)
+	requests[key] = append(requests[key], *recorded)
+
+	s.requestLog = append(s.requestLog, RequestLogEntry{
+		Method:     method,
+		Key:        key,
+		Header:     r.Header.Clone(),
+		Body:       body,
+		ReceivedAt: time.Now(),
+	})
+}
+
+func newUUID() string {
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// hasGETResponse reports whether registeredRoutes would
+// include the GET route for key, without building it
+func (s *_Server) hasGETResponse(key string) bool {
+	route := _Route{Method: http.MethodGet, Key: key}
+
+	s.onceMutex.Lock()
+	_, once := s.onceResponses[key]
+	s.onceMutex.Unlock()
+
+	_, static := s.httpGETResponses[key]
+	_, conditional := s.conditionalResponses[key]
+	_, delayed := s.delayedResponses[key]
+	_, generated := s.generators[key]
+	_, jsonp := s.jsonpResponses[key]
+	_, paged := s.pagedResponses[key]
+	_, remoteAddr := s.remoteAddrResponses[key]
+	_, stream := s.streams[key]
+	_, userAgent := s.userAgentResponses[key]
+	_, after := s.afterResponses[route]
+	_, count := s.countResponses[route]
+	_, roundRobin := s.roundRobins[route]
+	return once || static || conditional || delayed || generated || jsonp || paged ||
+		remoteAddr || stream || userAgent || after || count || roundRobin
+}
+
+// registeredRoutes returns every method and
+// key that has a response of any kind
+func (s *_Server) registeredRoutes() map[_Route]bool {
+	routes := map[_Route]bool{}
+	for _, method := range supportedMethods {
+		for key := range s.responsesFor(method) {
+			routes[_Route{Method: method, Key: key}] = true
+		}
+	}
+
+	var getKeys []string
+	for key := range s.conditionalResponses {
+		getKeys = append(getKeys, key)
+	}
+	for key := range s.delayedResponses {
+		getKeys = append(getKeys, key)
+	}
+	for key := range s.generators {
+		getKeys = append(getKeys, key)
+	}
+	for key := range s.jsonpResponses {
+		getKeys = append(getKeys, key)
+	}
+	s.onceMutex.Lock()
+	for key := range s.onceResponses {
+		getKeys = append(getKeys, key)
+	}
+	s.onceMutex.Unlock()
+	for key := range s.pagedResponses {
+		getKeys = append(getKeys, key)
+	}
+	for key := range s.remoteAddrResponses {
+		getKeys = append(getKeys, key)
+	}
+	for key := range s.streams {
+		getKeys = append(getKeys, key)
+	}
+	for key := range s.userAgentResponses {
+		getKeys = append(getKeys, key)
+	}
+	for _, key := range getKeys {
+		routes[_Route{Method: http.MethodGet, Key: key}] = true
+	}
+
+	for key := range s.contentTypeResponses {
+		routes[_Route{Method: http.MethodPost, Key: key}] = true
+	}
+
+	for route := range s.afterResponses {
+		routes[route] = true
+	}
+	for route := range s.countResponses {
+		routes[route] = true
+	}
+	for route := range s.roundRobins {
+		routes[route] = true
+	}
+	return routes
+}
+
+// requests returns a copy of the recorded requests for the
+// given method and key. The caller must hold requestsMutex
+func (s *_Server) requests(method, key string) []http.Request {
+	return append([]http.Request{}, s.requestsFor(method)[key]...)
+}
+
+func (s *_Server) requestsMade(method, key string) int {
+	s.requestsMutex.RLock()
+	defer s.requestsMutex.RUnlock()
+
+	return len(s.requestsFor(method)[key])
+}
+
+func (s *_Server) request(method, key string, index int) (*http.Request, bool) {
+	requests := s.requestsFor(method)[key]
+	if index < 0 || index >= len(requests) {
+		return nil, false
+	}
+	r := requests[index]
+	return &r, true
+}
+
+func (s *_Server) requestEntry(method, key string, index int) (RequestLogEntry, bool) {
+	for _, entry := range s.requestLog {
+		if entry.Method != method || entry.Key != key {
+			continue
+		}
+		if index == 0 {
+			return entry, true
+		}
+		index--
+	}
+	return RequestLogEntry{}, false
+}
+
+func (s *_Server) requestsFor(method string) map[string][]http.Request {
+	switch method {
+	case http.MethodGet:
+		return s.httpGETRequests
+	case http.MethodPatch:
+		return s.httpPATCHRequests
+	case http.MethodPost:
+		return s.httpPOSTRequests
+	case http.MethodTrace:
+		return s.httpTRACERequests
+	}
+	return nil
+}
+
+func (s *_Server) respond(w http.ResponseWriter, r *http.Request, method, key string, body []byte) {
+	if limit, ok := s.requestSizeLimits[_Route{Method: method, Key: key}]; ok && int64(len(body)) > limit {
+		http.Error(w, fmt.Sprintf("Request body exceeds %v bytes", limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	s.requestsMutex.Lock()
+	s.recordRequest(method, key, r, body)
+	if rw, ok := w.(*_ResponseWriter); ok {
+		rw.route = &_Route{Method: method, Key: key}
+		s.recordedResponses[*rw.route] = append(s.recordedResponses[*rw.route], rw)
+	}
+	s.requestsMutex.Unlock()
+
+	if method == http.MethodGet {
+		for _, assertion := range s.assertions[key] {
+			s.runAssertion(assertion, r, key, body)
+		}
+	}
+
+	for srcHeader, dstHeader := range s.headerForwardingRules {
+		if value := r.Header.Get(srcHeader); value != "" {
+			w.Header().Set(dstHeader, value)
+		}
+	}
+
+	if recording := s.recording; recording != nil {
+		s.proxy(w, r, recording, method, key, body)
+		return
+	}
+
+	if value := r.Header.Get(s.idempotencyKeyHeader); s.idempotencyKeyHeader != "" && value != "" {
+		s.requestsMutex.Lock()
+		responses := s.idempotencyResponses
+		first, ok := responses[value]
+		if ok {
+			s.idempotencyKeyReuses[_Route{Method: method, Key: key}]++
+		} else {
+			responses[value] = nil
+		}
+		s.requestsMutex.Unlock()
+
+		switch {
+		case ok && first == nil:
+			http.Error(w, fmt.Sprintf("Idempotency key '%v' is in use by a request in progress", value), http.StatusConflict)
+			return
+		case ok && s.idempotencyKeyReplay:
+			writeRecorded(w, first)
+			return
+		case ok:
+			http.Error(w, fmt.Sprintf("Idempotency key '%v' was already used", value), http.StatusConflict)
+			return
+		}
+
+		if rw, ok := w.(*_ResponseWriter); ok {
+			defer func() {
+				recorded := rw.recorded()
+				s.requestsMutex.Lock()
+				responses[value] = recorded
+				s.requestsMutex.Unlock()
+			}()
+		}
+	}
+
+	if method == http.MethodGet {
+		for _, requiredKey := range s.dependencies[key] {
+			if s.requestsMade(http.MethodGet, requiredKey) == 0 {
+				http.Error(w, fmt.Sprintf("Required GET request for '%v' was not made", requiredKey), http.StatusPreconditionFailed)
+				return
+			}
+		}
+	}
+
+	if quota, ok := s.quotas[_Route{Method: method, Key: key}]; ok {
+		if atomic.AddInt64(&quota.requests, 1) > quota.maxRequests {
+			atomic.AddInt64(&quota.exceeded, 1)
+			http.Error(w, fmt.Sprintf("Request quota exceeded for '%v'", key), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if limit, ok := s.concurrencyLimits[_Route{Method: method, Key: key}]; ok {
+		if !limit.acquire() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, fmt.Sprintf("Concurrency limit reached for '%v'", key), http.StatusServiceUnavailable)
+			return
+		}
+		defer limit.release()
+	}
+
+	if timeout, ok := s.requestTimeouts[key]; ok && method == http.MethodGet {
+		// the handler keeps running after a timeout, when
+		// handleRequest has returned and no longer holds off Reset
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = s.holdOffReset(r)
+			defer releaseReset(r)
+			s.serveRoute(w, r, method, key, body)
+		})
+		http.TimeoutHandler(handler, timeout, fmt.Sprintf("Request timeout for '%v'", key)).ServeHTTP(w, r)
+		return
+	}
+
+	s.serveRoute(w, r, method, key, body)
+}
+
+func (s *_Server) responsesFor(method string) map[string]Response {
+	switch method {
+	case http.MethodGet:
+		return s.httpGETResponses
+	case http.MethodPatch:
+		return s.httpPATCHResponses
+	case http.MethodPost:
+		return s.httpPOSTResponses
+	}
+	return nil
+}
+
+func (s *_Server) serveRoute(w http.ResponseWriter, r *http.Request, method, key string, body []byte) {
+	if slowStart, ok := s.slowStarts[_Route{Method: method, Key: key}]; ok {
+		if atomic.CompareAndSwapInt32(&slowStart.started, 0, 1) {
+			sleep(r, slowStart.delay)
+		}
+	}
+
+	if s.echoHandlers[_Route{Method: method, Key: strings.SplitN(key, "?", 2)[0]}] {
+		s.writeEcho(w, r, body)
+		return
+	}
+
+	if stream, ok := s.streams[key]; ok && method == http.MethodGet {
+		releaseReset(r)
+		s.writeStream(w, stream)
+		return
+	}
+
+	response, ok := s.lookupResponse(r, method, key)
+	if !ok && s.alwaysResponse != nil {
+		response, ok = *s.alwaysResponse, true
+	}
+	if !ok {
+		message := fmt.Sprintf("No http%vResponse for '%v'", method, truncateKey(key))
+		if closest, ok := closestKey(s.responsesFor(method), key); ok {
+			message += fmt.Sprintf(". Closest registered key '%v' differs at: %v", truncateKey(closest), firstDifference(closest, key))
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(message))
+		return
+	}
+
+	if contentType, ok := s.contentTypes[_Route{Method: method, Key: key}]; ok {
+		response.ContentType = contentType
+	}
+
+	if transform, ok := s.bodyTransformers[key]; ok && method == http.MethodGet {
+		response.Body = transform(response.Body, r)
+	}
+
+	if callback, ok := s.responseCallbacks[_Route{Method: method, Key: key}]; ok {
+		response.Headers = response.Headers.Clone()
+		callback(r, &response)
+	}
+
+	if s.autoCompress[key] && method == http.MethodGet {
+		response.Headers = response.Headers.Clone()
+		if response.Headers == nil {
+			response.Headers = make(http.Header)
+		}
+		response.Headers.Add("Vary", "Accept-Encoding")
+		if encoding := negotiateEncoding(r.Header.Get("Accept-Encoding")); encoding != "" {
+			response.Headers.Set("Content-Encoding", encoding)
+			response.Body = compress(encoding, response.Body)
+		}
+	}
+
+	if afterBytes, ok := s.abortAfterBytes[key]; ok && method == http.MethodGet {
+		s.requestsMutex.Lock()
+		s.abortedRequests[_Route{Method: method, Key: key}]++
+		s.requestsMutex.Unlock()
+		s.writeAborted(w, response, afterBytes)
+		return
+	}
+
+	s.writeResponse(w, response)
+}
+
+// compress returns body compressed with encoding,
+// which is either "gzip" or "deflate"
+func compress(encoding, body string) string {
+	var compressed bytes.Buffer
+	var zw io.WriteCloser
+	if encoding == "gzip" {
+		zw = gzip.NewWriter(&compressed)
+	} else {
+		zw = zlib.NewWriter(&compressed)
+	}
+	zw.Write([]byte(body))
+	zw.Close()
+	return compressed.String()
+}
+
+// negotiateEncoding returns the preferred content encoding
+// of gzip and deflate that acceptEncoding does not refuse
+// with q=0, or "" if neither is accepted
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		refused := false
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				value, err := strconv.ParseFloat(q[2:], 64)
+				refused = err == nil && value == 0
+			}
+		}
+		if coding != "" {
+			accepted[coding] = !refused
+		}
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if ok, listed := accepted[encoding]; ok || (!listed && accepted["*"]) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// comparedKeyLength caps the bytes of a key that closestKey
+// compares and 404 messages quote, since POST keys hold
+// whole uploaded files
+const comparedKeyLength = 256
+
+// closestKey returns the key of responses with the smallest
+// edit distance to key over their first comparedKeyLength
+// bytes, preferring the longest common prefix on ties
+func closestKey(responses map[string]Response, key string) (string, bool) {
+	keys := make([]string, 0, len(responses))
+	for k := range responses {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	closest, distance, prefix := "", -1, 0
+	for _, k := range keys {
+		d := editDistance(comparedPrefix(k), comparedPrefix(key))
+		if distance >= 0 && d > distance {
+			continue
+		}
+		if p := commonPrefixLength(k, key); distance < 0 || d < distance || p > prefix {
+			closest, distance, prefix = k, d, p
+		}
+	}
+	return closest, distance >= 0
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// firstDifference describes where registered and
+// requested first differ
+func firstDifference(registered, requested string) string {
+	i := commonPrefixLength(registered, requested)
+	return fmt.Sprintf("offset %v, registered '%v', requested '%v'", i, truncateKey(registered[i:]), truncateKey(requested[i:]))
+}
+
+// commonPrefixLength returns the number of
+// leading bytes a and b have in common
+func commonPrefixLength(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// comparedPrefix returns the first comparedKeyLength bytes of key
+func comparedPrefix(key string) string {
+	if len(key) > comparedKeyLength {
+		return key[:comparedKeyLength]
+	}
+	return key
+}
+
+// truncateKey shortens key to comparedKeyLength
+// bytes for quoting in messages
+func truncateKey(key string) string {
+	if len(key) > comparedKeyLength {
+		return key[:comparedKeyLength] + "..."
+	}
+	return key
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// mediaType returns the media type of contentType
+// without any parameters such as the boundary
+func mediaType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+// readResponse reads and closes the body of resp and
+// converts it to a Response
+func readResponse(resp *http.Response) (Response, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Response{}, err
+	}
+
+	headers := resp.Header.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Del("Content-Length")
+	headers.Del("Content-Type")
+	return Response{
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Headers:     headers,
+		Body:        string(body),
+	}, nil
+}
+
+// removeQueryParam removes every occurrence of the parameter
+// name from rawQuery without reordering the others. It returns
+// the remaining query and the first value of the parameter
+func removeQueryParam(rawQuery, name string) (string, string) {
+	var kept []string
+	var value string
+	found := false
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+
+		paramName, paramValue := param, ""
+		if i := strings.Index(param, "="); i >= 0 {
+			paramName, paramValue = param[:i], param[i+1:]
+		}
+		if unescaped, err := url.QueryUnescape(paramName); err == nil && unescaped == name {
+			if !found {
+				value, _ = url.QueryUnescape(paramValue)
+				found = true
+			}
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&"), value
+}
+
+// withHeaders returns response with non-nil Headers
+func withHeaders(response Response) Response {
+	if response.Headers == nil {
+		response.Headers = make(http.Header)
+	}
+	return response
+}
+
+// sortRoutes sorts routes by method and then key
+func sortRoutes(routes []_Route) {
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Method != routes[j].Method {
+			return routes[i].Method < routes[j].Method
+		}
+		return routes[i].Key < routes[j].Key
+	})
+}
+
+// storeMax atomically raises *addr to v
+// if v is greater
+func storeMax(addr *int64, v int64) {
+	for {
+		current := atomic.LoadInt64(addr)
+		if v <= current || atomic.CompareAndSwapInt64(addr, current, v) {
+			return
+		}
+	}
+}
+
+// sleep waits for d, returning early if
+// the client goes away
+func sleep(r *http.Request, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+}
+
+// runAssertion calls assertion with a copy of r in its own
+// goroutine, recording the panic if there is one
+func (s *_Server) runAssertion(assertion func(*http.Request), r *http.Request, key string, body []byte) {
+	req := r.Clone(r.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	s.assertionWaitGroup.Add(1)
+	go func() {
+		defer s.assertionWaitGroup.Done()
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				s.assertionMutex.Lock()
+				s.assertionPanics = append(s.assertionPanics, fmt.Sprintf("assertion for '%v' panicked: %v", key, recovered))
+				s.assertionMutex.Unlock()
+			}
+		}()
+		assertion(req)
+	}()
+}
+
+func (s *_Server) takeOnceResponse(key string) (Response, bool) {
+	s.onceMutex.Lock()
+	defer s.onceMutex.Unlock()
+
+	response, ok := s.onceResponses[key]
+	if ok {
+		delete(s.onceResponses, key)
+	}
+	return response, ok
+}
+
+// transformRequest passes a copy of r to the request transformer
+// and returns the request it produced along with its body
+func (s *_Server) transformRequest(r *http.Request, body []byte) (*http.Request, []byte, error) {
+	clone := r.Clone(r.Context())
+	clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	transformed := s.requestTransformer(clone)
+	if transformed == nil {
+		clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return clone, body, nil
+	}
+	if transformed.Body == nil {
+		return transformed, nil, nil
+	}
+
+	transformedBody, err := ioutil.ReadAll(transformed.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	transformed.Body = ioutil.NopCloser(bytes.NewReader(transformedBody))
+	return transformed, transformedBody, nil
+}
+
+// writeAborted writes the headers of response, announcing the
+// full body, and the first afterBytes of the body before
+// closing the connection
+func (s *_Server) writeAborted(w http.ResponseWriter, response Response, afterBytes int) {
+	body := response.Body
+	if afterBytes < len(body) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		response.Body = body[:afterBytes]
+	}
+	s.writeResponse(w, response)
+
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	if hijacker, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+}
+
+func (s *_Server) writeEcho(w http.ResponseWriter, r *http.Request, body []byte) {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (s *_Server) writeStream(w http.ResponseWriter, stream _Stream) {
+	if stream.contentType != "" {
+		w.Header().Set("Content-Type", stream.contentType)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := stream.reader.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// releaseReset lets Reset proceed while the rest of the
+// response for r is written
+func releaseReset(r *http.Request) {
+	if release, ok := r.Context().Value(releaseResetKey{}).(func()); ok {
+		release()
+	}
+}
+
+// writeRecorded writes the response captured by recorder again
+func writeRecorded(w http.ResponseWriter, recorder *httptest.ResponseRecorder) {
+	for name, values := range recorder.Result().Header {
+		w.Header()[name] = append([]string{}, values...)
+	}
+	w.WriteHeader(recorder.Code)
+	w.Write(recorder.Body.Bytes())
+}
+
+func (s *_Server) writeResponse(w http.ResponseWriter, response Response) {
+	statusCode := response.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	for name := range response.Headers {
+		if _, ok := s.defaultResponseHeaders[name]; ok {
+			w.Header().Del(name)
+		}
+	}
+	for name, values := range response.Headers {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+
+	if response.ContentType != "" {
+		w.Header().Set("Content-Type", response.ContentType)
+	} else if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
 	}
 
-	w.WriteHeader(response.StatusCode)
-	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
 	w.Write([]byte(response.Body))
 }
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAlwaysResponseWithoutKey(t *testing.T) {
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetAlwaysResponse(http.StatusAccepted, "text/plain", "always")
+
+	post, err := http.NewRequest(http.MethodPost, s.URL().String()+"/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Header.Set("Content-Type", "application/json")
+	put, err := http.NewRequest(http.MethodPut, s.URL().String()+"/put", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*http.Request{post, put} {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusAccepted || string(body) != "always" {
+			t.Errorf("expected status %v and body 'always' for %v, but got %v and '%v'", http.StatusAccepted, req.Method, resp.StatusCode, string(body))
+		}
+	}
+}
+
+func TestClosestKeyLargeUpload(t *testing.T) {
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	registered := strings.Repeat("a", 1<<20)
+	s.SetPOSTResponseBody("/upload? "+registered, "ok")
+
+	var upload bytes.Buffer
+	mw := multipart.NewWriter(&upload)
+	fw, err := mw.CreateFormFile("file", "upload.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(registered[1:] + "b"))
+	mw.Close()
+
+	startedAt := time.Now()
+	resp, err := http.Post(s.URL().String()+"/upload", mw.FormDataContentType(), &upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(startedAt); elapsed > 5*time.Second {
+		t.Errorf("expected the 404 within 5s, but it took %v", elapsed)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %v, but got %v", http.StatusNotFound, resp.StatusCode)
+	}
+	if len(body) > 4*comparedKeyLength {
+		t.Errorf("expected the 404 body to quote truncated keys, but got %v bytes", len(body))
+	}
+}
+
+func TestGettersWhileServing(t *testing.T) {
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	const key = "/concurrent?"
+	s.SetGETResponseBody(key, "body")
+	s.SetMaxRequests(http.MethodGet, key, 50)
+	s.SetConcurrencyLimit(http.MethodGet, key, 100)
+
+	url := s.URL().String() + "/concurrent"
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}()
+		go func(i int) {
+			defer wg.Done()
+			s.GetGETRequests(key)
+			s.GetResponseLatency(http.MethodGet, key, i/2)
+			s.GetAverageResponseLatency(http.MethodGet, key)
+			s.GetLatencyHistogram(http.MethodGet, key)
+			s.RecordedResponseFor(http.MethodGet, key, i/2)
+			s.GetAbortedRequestCount(http.MethodGet, key)
+			s.GetQuotaExceededCount(http.MethodGet, key)
+			s.GetMaxConcurrentRequests(http.MethodGet, key)
+			s.RequestLog()
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(s.GetGETRequests(key)); n != 100 {
+		t.Errorf("expected 100 requests for '%v', but got %v", key, n)
+	}
+	if n := s.GetQuotaExceededCount(http.MethodGet, key); n != 50 {
+		t.Errorf("expected 50 requests over quota for '%v', but got %v", key, n)
+	}
+}
+
+func TestIdempotencyKeyReuseInFlight(t *testing.T) {
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	const key = "/idempotent?"
+	s.SetGETResponseBody(key, "first")
+	s.SetIdempotencyKeyHeader("Idempotency-Key")
+	s.SetIdempotencyKeyReplay(true)
+	s.SetSlowStart(http.MethodGet, key, 300*time.Millisecond)
+
+	get := func() (int, string) {
+		req, err := http.NewRequest(http.MethodGet, s.URL().String()+"/idempotent", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Idempotency-Key", "k")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		if code, body := get(); code != http.StatusOK || body != "first" {
+			t.Errorf("expected status %v and body 'first', but got %v and '%v'", http.StatusOK, code, body)
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if code, _ := get(); code != http.StatusConflict {
+		t.Errorf("expected status %v while the first request is served, but got %v", http.StatusConflict, code)
+	}
+
+	<-first
+	if code, body := get(); code != http.StatusOK || body != "first" {
+		t.Errorf("expected the first response replayed, but got %v and '%v'", code, body)
+	}
+}
+
+func TestNonMultipartPOST(t *testing.T) {
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	resp, err := http.Post(s.URL().String()+"/upload", "application/json", strings.NewReader(`{"file":"none"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status %v, but got %v", http.StatusInternalServerError, resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "multipart/form-data") {
+		t.Errorf("expected the multipart parsing error as body, but got %v", string(body))
+	}
+}
+
+func TestOpenAPITemplateWithOnceResponses(t *testing.T) {
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	spec := []byte(`{"paths":{"/users/{id}":{"get":{"responses":{"200":{"content":{"application/json":{"example":{"id":1}}}}}}}}}`)
+	if err := s.SetupFromOpenAPISpec(spec); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		s.SetGETResponseOnce("/users/"+strconv.Itoa(i)+"?", Response{Body: "once"})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(s.URL().String() + "/users/" + strconv.Itoa(i%25))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestPOSTResponseBodyForContentType(t *testing.T) {
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetPOSTResponseBodyForContentType("/upload?", "application/json", http.StatusAccepted, "json")
+	s.SetPOSTResponseBodyForContentType("/upload?", "text/plain", http.StatusOK, "text")
+
+	for contentType, expected := range map[string]string{"application/json": "json", "text/plain": "text"} {
+		resp, err := http.Post(s.URL().String()+"/upload", contentType, strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != expected {
+			t.Errorf("expected body '%v' for %v, but got '%v'", expected, contentType, string(body))
+		}
+	}
+}
+
+func TestPOSTResponseByContentType(t *testing.T) {
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetPOSTResponseByContentType("/upload?", "application/json", Response{
+		StatusCode: http.StatusCreated,
+		Body:       `{"created":true}`,
+	})
+
+	resp, err := http.Post(s.URL().String()+"/upload", "application/json; charset=utf-8", strings.NewReader(`{"name":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || string(body) != `{"created":true}` {
+		t.Errorf("expected status %v and the JSON response, but got %v and %v", http.StatusCreated, resp.StatusCode, string(body))
+	}
+	if n := len(s.GetPOSTRequests("/upload?")); n != 1 {
+		t.Errorf("expected 1 request for '/upload?', but got %v", n)
+	}
+}
+
+func TestRecordingWithoutKey(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.Method))
+	}))
+	defer upstream.Close()
+
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.StartRecording(upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	post, err := http.NewRequest(http.MethodPost, s.URL().String()+"/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Header.Set("Content-Type", "application/json")
+	put, err := http.NewRequest(http.MethodPut, s.URL().String()+"/put", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*http.Request{post, put} {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "upstream "+req.Method {
+			t.Errorf("expected the upstream response for %v, but got '%v'", req.Method, string(body))
+		}
+	}
+
+	cassette := s.StopRecording()
+	if n := len(cassette.Interactions); n != 2 {
+		t.Fatalf("expected 2 interactions, but got %v", n)
+	}
+	for i, key := range []string{"/json? {}", "/put? {}"} {
+		if cassette.Interactions[i].Key != key {
+			t.Errorf("expected interaction %v keyed '%v', but got '%v'", i, key, cassette.Interactions[i].Key)
+		}
+	}
+}
+
+func TestResetWhileServing(t *testing.T) {
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetGETResponseBody("/reset?", "body")
+	url := s.URL().String() + "/reset"
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				resp, err := http.Get(url)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				s.GetGETRequests("/reset?")
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		time.Sleep(10 * time.Millisecond)
+		s.Reset()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestRequestCount(t *testing.T) {
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetHealthCheck("/health")
+	s.SetResponseInterceptor(func(w http.ResponseWriter, r *http.Request, next func()) {
+		if r.URL.Path == "/intercepted" {
+			w.WriteHeader(http.StatusTeapot)
+			return
+		}
+		next()
+	})
+
+	for _, path := range []string{"/health", "/intercepted", "/missing"} {
+		resp, err := http.Get(s.URL().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if n := s.GetRequestCount(); n != 3 {
+		t.Errorf("expected 3 requests, but got %v", n)
+	}
+	if n := s.GetRequestCountByMethod(http.MethodGet); n != 3 {
+		t.Errorf("expected 3 GET requests, but got %v", n)
+	}
+}
+
+func TestResetDuringStream(t *testing.T) {
+	s := New()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	s.SetResponseStreamFrom("/stream?", pr, "text/plain")
+	go pw.Write([]byte("first"))
+
+	resp, err := http.Get(s.URL().String() + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reset := make(chan struct{})
+	go func() {
+		s.Reset()
+		close(reset)
+	}()
+
+	select {
+	case <-reset:
+	case <-time.After(time.Second):
+		t.Errorf("expected Reset to return while a stream is open, but it was still blocked after 1s")
+	}
+}
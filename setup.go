@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type _SetupConfig struct {
+	Routes []_SetupRoute `json:"routes" yaml:"routes"`
+}
+
+type _SetupRoute struct {
+	Method      string `json:"method" yaml:"method"`
+	Path        string `json:"path" yaml:"path"`
+	Body        string `json:"body" yaml:"body"`
+	StatusCode  int    `json:"status" yaml:"status"`
+	ContentType string `json:"contentType" yaml:"contentType"`
+	Response    string `json:"response" yaml:"response"`
+}
+
+func (s *_Server) SetResponseFromFixtureDir(method, basePath, dir string) error {
+	var config _SetupConfig
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		ext := filepath.Ext(rel)
+		config.Routes = append(config.Routes, _SetupRoute{
+			Method:      method,
+			Path:        path.Join("/", basePath, filepath.ToSlash(strings.TrimSuffix(rel, ext))),
+			ContentType: mime.TypeByExtension(ext),
+			Response:    string(data),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.setup(config)
+}
+
+func (s *_Server) SetupFromJSON(data []byte) error {
+	var config _SetupConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	return s.setup(config)
+}
+
+func (s *_Server) SetupFromYAML(data []byte) error {
+	var config _SetupConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	return s.setup(config)
+}
+
+// privates
+func (s *_Server) setup(config _SetupConfig) error {
+	for _, route := range config.Routes {
+		method := strings.ToUpper(route.Method)
+		responses := s.responsesFor(method)
+		if responses == nil {
+			return fmt.Errorf("Unsupported method '%v' for '%v'", route.Method, route.Path)
+		}
+
+		key := route.Path
+		if !strings.Contains(key, "?") {
+			key += "?"
+		}
+		switch method {
+		case http.MethodPatch:
+			key += " " + string(normalizeJSON([]byte(route.Body)))
+		case http.MethodPost:
+			key += " " + route.Body
+		}
+
+		statusCode := route.StatusCode
+		if statusCode == 0 {
+			statusCode = http.StatusOK
+		}
+
+		responses[key] = Response{
+			StatusCode:  statusCode,
+			ContentType: route.ContentType,
+			Headers:     make(http.Header),
+			Body:        route.Response,
+		}
+	}
+	return nil
+}